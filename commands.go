@@ -0,0 +1,206 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cockroachlabs/metrics-exporter/internal/lib"
+)
+
+// defaultPreviewMax is the upper range of the buckets preview, if the configuration does not set one.
+const defaultPreviewMax = 10 * time.Second
+
+// convertCommand translates a file in the Prometheus text format, and writes the
+// translated metrics in the same format.
+func convertCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	configLocation := flags.String("config", "", "YAML configuration")
+	output := flags.String("output", "", "output file (default stdout)")
+	overrides := configFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s convert [flags] [metrics file, default stdin]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	config, err := lib.LoadOfflineConfig(*configLocation, overrides())
+	if err != nil {
+		return err
+	}
+	input := "-"
+	if flags.NArg() > 0 {
+		input = flags.Arg(0)
+	}
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	return convert(config, input, out)
+}
+
+// convert translates the metrics read from the input file (- for stdin).
+func convert(config *lib.Config, input string, out io.Writer) error {
+	var source lib.Source = lib.NewFileSource(input)
+	if input == "-" {
+		source = lib.NewStdinSource()
+		input = "stdin"
+	}
+	return translate(config, source, input, out)
+}
+
+// translate reads and translates the metrics of the source. There is no deadline:
+// the upstream timeout only applies to the scrapes.
+func translate(config *lib.Config, source lib.Source, name string, out io.Writer) error {
+	ctx := context.Background()
+	metricFamilies, err := source.ReadMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %w", name, err)
+	}
+	if err := lib.CreateMetricsWriter(config).TranslateMetrics(ctx, metricFamilies); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	if err := lib.WriteText(w, metricFamilies); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// validateCommand checks the configuration files. The overrides from the environment
+// and the command line are applied to each file; without files, the configuration
+// built from the overrides only is checked.
+func validateCommand(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configLocation := flags.String("config", "", "YAML configuration")
+	overrides := configFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [-config file] [configuration files]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	files := flags.Args()
+	if *configLocation != "" {
+		files = append([]string{*configLocation}, files...)
+	}
+	return validate(files, overrides(), os.Stdout, os.Stderr)
+}
+
+// validate checks the configuration files, and reports one line for each file:
+// the valid files to out, the problems to errOut.
+func validate(files []string, overrides map[string]string, out io.Writer, errOut io.Writer) error {
+	if len(files) == 0 {
+		files = []string{""}
+	}
+	invalid := 0
+	for _, file := range files {
+		if _, err := lib.LoadConfigWithOverrides(file, overrides); err != nil {
+			fmt.Fprintln(errOut, err)
+			invalid++
+			continue
+		}
+		if file == "" {
+			file = "configuration"
+		}
+		fmt.Fprintf(out, "%s: valid\n", file)
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d configuration files are invalid", invalid, len(files))
+	}
+	return nil
+}
+
+// previewBucketsCommand prints the upper bounds of the buckets of the translated histograms.
+func previewBucketsCommand(args []string) error {
+	flags := flag.NewFlagSet("preview-buckets", flag.ExitOnError)
+	configLocation := flags.String("config", "", "YAML configuration")
+	max := flags.Int("endns", 0, "upper range in nanoseconds (default the configured endns, or 10s)")
+	overrides := configFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s preview-buckets [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	config, err := lib.LoadOfflineConfig(*configLocation, overrides())
+	if err != nil {
+		return err
+	}
+	if *max == 0 {
+		*max = config.Bucket.Endns
+	}
+	if *max == 0 {
+		*max = int(defaultPreviewMax)
+	}
+	bounds := lib.BucketBounds(&config.Bucket, float64(*max))
+	w := bufio.NewWriter(os.Stdout)
+	for _, b := range bounds {
+		fmt.Fprintln(w, strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	fmt.Fprintf(w, "+Inf\n# %d buckets\n", len(bounds)+1)
+	return w.Flush()
+}
+
+// queryStatementCommand prints the SQL text of a statement, given its fingerprint id,
+// using the database connection of the custom metrics.
+func queryStatementCommand(args []string) error {
+	flags := flag.NewFlagSet("query-statement", flag.ExitOnError)
+	configLocation := flags.String("config", "", "YAML configuration")
+	timeout := flags.Duration("timeout", 10*time.Second, "max time to connect and run the query")
+	setLogLevel := logFlags(flags)
+	overrides := configFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s query-statement [flags] <fingerprint id>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	setLogLevel()
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("A statement fingerprint id is required")
+	}
+	config, err := lib.LoadConfigWithOverrides(*configLocation, overrides())
+	if err != nil {
+		return err
+	}
+	if !config.HasCustom() {
+		return errors.New("The custom section, with the database url, is required")
+	}
+	// The setting only disables the HTTP endpoint.
+	config.Custom.DisableGetStatement = false
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	db, err := lib.NewCollector(ctx, config.Custom, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to the database: %w", err)
+	}
+	defer db.Close()
+	res, err := db.GetStatement(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Println(res)
+	return nil
+}
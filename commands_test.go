@@ -0,0 +1,125 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachlabs/metrics-exporter/internal/lib"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const convertInput = `# HELP sql_conns Number of open SQL connections
+# TYPE sql_conns gauge
+sql_conns 3
+# HELP sql_query_count Number of SQL queries
+# TYPE sql_query_count counter
+sql_query_count{node_id="1"} 120
+`
+
+func writeFile(t *testing.T, name string, content string) string {
+	location := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(location, []byte(content), 0600))
+	return location
+}
+
+func TestConvert(t *testing.T) {
+	assert := assert.New(t)
+	config := &lib.Config{}
+	var out bytes.Buffer
+	require.NoError(t, convert(config, writeFile(t, "metrics.txt", convertInput), &out))
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Contains(t, metricFamilies, "sql_conns")
+	assert.Equal(3.0, metricFamilies["sql_conns"].Metric[0].GetGauge().GetValue())
+	require.Contains(t, metricFamilies, "sql_query_count")
+	assert.Equal(120.0, metricFamilies["sql_query_count"].Metric[0].GetCounter().GetValue())
+
+	// The output can be converted again, unchanged.
+	var again bytes.Buffer
+	require.NoError(t, convert(config, writeFile(t, "converted.txt", out.String()), &again))
+	assert.Equal(out.String(), again.String())
+}
+
+func TestConvertMalformed(t *testing.T) {
+	input := writeFile(t, "metrics.txt", "sql_conns{node_id=\"1\" 3\n")
+	var out bytes.Buffer
+	err := convert(&lib.Config{}, input, &out)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "Error reading "+input+": "), err.Error())
+	assert.Empty(t, out.String())
+
+	err = convert(&lib.Config{}, filepath.Join(t.TempDir(), "missing.txt"), &out)
+	assert.Error(t, err)
+}
+
+// slowReader returns the data after a delay.
+type slowReader struct {
+	delay time.Duration
+	r     io.Reader
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	s.delay = 0
+	return s.r.Read(p)
+}
+
+func TestConvertNoDeadline(t *testing.T) {
+	// The upstream timeout does not bound the conversion, nor the url and port are required.
+	config, err := lib.LoadOfflineConfig("", map[string]string{
+		"bucket.startns": "1000", "bucket.bins": "10", "upstream.timeout": "10ms",
+	})
+	require.NoError(t, err)
+	_, err = lib.LoadConfigWithOverrides("", map[string]string{
+		"bucket.startns": "1000", "bucket.bins": "10",
+	})
+	assert.Error(t, err)
+
+	source := lib.NewReaderSource(&slowReader{delay: 100 * time.Millisecond, r: strings.NewReader(convertInput)})
+	var out bytes.Buffer
+	require.NoError(t, translate(config, source, "stdin", &out))
+	assert.Contains(t, out.String(), "sql_conns 3")
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	const config = "url: http://localhost:8080/_status/vars\nbucket:\n  startns: 100000\n  bins: 10\n"
+	valid := writeFile(t, "valid.yaml", config+"port: 8888\n")
+	invalid := writeFile(t, "invalid.yaml", config+"port: -1\n")
+	var out, errOut bytes.Buffer
+	err := validate([]string{valid, invalid}, nil, &out, &errOut)
+	assert.EqualError(err, "1 of 2 configuration files are invalid")
+	assert.Equal(valid+": valid\n", out.String())
+	assert.Equal(invalid+": port: Invalid port range\n", errOut.String())
+
+	out.Reset()
+	errOut.Reset()
+	require.NoError(t, validate([]string{valid, valid}, map[string]string{"port": "9090"}, &out, &errOut))
+	assert.Equal(valid+": valid\n"+valid+": valid\n", out.String())
+	assert.Empty(errOut.String())
+
+	// The problems of a file are listed under its line.
+	out.Reset()
+	errOut.Reset()
+	err = validate([]string{invalid}, map[string]string{"bucket.bins": "0"}, &out, &errOut)
+	assert.EqualError(err, "1 of 1 configuration files are invalid")
+	assert.Empty(out.String())
+	assert.Equal(invalid+`: 2 problems found:
+  port: Invalid port range
+  bucket.bins: The number of bins (0) must be between 1 and 100
+`, errOut.String())
+}
@@ -0,0 +1,189 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// EndpointAuth protects a set of endpoints. A request is authorized if it is
+// authenticated by one of the configured methods.
+// * Endpoints: the protected paths; a path ending with a slash protects the whole subtree (e.g. /statement/)
+// * Users: basic auth users, with the bcrypt hashes of their passwords
+// * TokenFiles: files with the bearer tokens accepted, one per file, read at startup
+// * Clients: common names or subject alternative names of the verified client certificates accepted
+type EndpointAuth struct {
+	Endpoints  []string
+	Users      []BasicUser `yaml:"users,omitempty"`
+	TokenFiles []string    `yaml:"tokenfiles,omitempty"`
+	Clients    []string    `yaml:"clients,omitempty"`
+}
+
+// BasicUser is a basic auth user.
+// * Username: the user name
+// * PasswordHash: bcrypt hash of the password (e.g. htpasswd -nbBC 10 "" password)
+type BasicUser struct {
+	Username     string
+	PasswordHash string `yaml:"passwordhash"`
+}
+
+func (a EndpointAuth) checkConfig() error {
+	var errs ConfigErrors
+	if len(a.Endpoints) == 0 {
+		errs.add("endpoints", errors.New("The auth endpoints are required"))
+	}
+	for i, e := range a.Endpoints {
+		if !strings.HasPrefix(e, "/") {
+			errs.add(fmt.Sprintf("endpoints[%d]", i), errors.New("Invalid auth endpoint: "+e))
+		}
+	}
+	if len(a.Endpoints) > 0 && len(a.Users) == 0 && len(a.TokenFiles) == 0 && len(a.Clients) == 0 {
+		errs.add("", errors.New("No authentication method configured for "+strings.Join(a.Endpoints, ", ")))
+	}
+	for i, u := range a.Users {
+		if u.Username == "" {
+			errs.add(fmt.Sprintf("users[%d].username", i), errors.New("The basic auth username is required"))
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			errs.add(fmt.Sprintf("users[%d].passwordhash", i), errors.New("Invalid password hash for user "+u.Username))
+		}
+	}
+	return errs.err()
+}
+
+// Reasons of the unauthorized requests.
+const (
+	authMissing = "missing"
+	authInvalid = "invalid"
+)
+
+// Authenticator enforces the authentication of the endpoints.
+type Authenticator struct {
+	rules []*authRule
+}
+
+type authRule struct {
+	endpoints []string
+	users     map[string][]byte
+	tokens    [][]byte
+	clients   map[string]bool
+}
+
+// NewAuthenticator instantiates an Authenticator, reading the bearer tokens.
+func NewAuthenticator(config []EndpointAuth) (*Authenticator, error) {
+	res := &Authenticator{}
+	for _, a := range config {
+		rule := &authRule{
+			endpoints: a.Endpoints,
+			users:     make(map[string][]byte, len(a.Users)),
+			clients:   make(map[string]bool, len(a.Clients)),
+		}
+		for _, u := range a.Users {
+			rule.users[u.Username] = []byte(u.PasswordHash)
+		}
+		for _, file := range a.TokenFiles {
+			token, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			token = []byte(strings.TrimSpace(string(token)))
+			if len(token) == 0 {
+				return nil, errors.New("No token found in " + file)
+			}
+			rule.tokens = append(rule.tokens, token)
+		}
+		for _, c := range a.Clients {
+			rule.clients[c] = true
+		}
+		res.rules = append(res.rules, rule)
+	}
+	return res, nil
+}
+
+// Wrap returns a handler that rejects the unauthorized requests to the protected
+// endpoints with 401 Unauthorized, and forwards the others to the handler.
+func (a *Authenticator) Wrap(handler http.Handler) http.Handler {
+	if len(a.rules) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, endpoint := a.match(r.URL.Path)
+		if rule == nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		reason := rule.authenticate(r)
+		if reason == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		log.Warnf("Unauthorized request to %s from %s: %s credentials", r.URL.Path, r.RemoteAddr, reason)
+		unauthorizedRequests.WithLabelValues(endpoint, reason).Inc()
+		if len(rule.users) > 0 {
+			w.Header().Add("WWW-Authenticate", `Basic realm="metrics-exporter"`)
+		}
+		if len(rule.tokens) > 0 {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="metrics-exporter"`)
+		}
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// match returns the rule protecting the path, and the matching endpoint.
+// The most specific endpoint wins.
+func (a *Authenticator) match(path string) (*authRule, string) {
+	var res *authRule
+	var endpoint string
+	for _, rule := range a.rules {
+		for _, e := range rule.endpoints {
+			matches := path == e || (strings.HasSuffix(e, "/") && strings.HasPrefix(path, e))
+			if matches && len(e) > len(endpoint) {
+				res, endpoint = rule, e
+			}
+		}
+	}
+	return res, endpoint
+}
+
+// authenticate returns the reason why the request is not authorized,
+// or an empty string if it is.
+func (r *authRule) authenticate(req *http.Request) string {
+	reason := authMissing
+	if len(r.clients) > 0 && req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		for _, name := range certificateNames(req.TLS.VerifiedChains[0][0]) {
+			if r.clients[name] {
+				return ""
+			}
+		}
+		reason = authInvalid
+	}
+	if username, password, ok := req.BasicAuth(); ok && len(r.users) > 0 {
+		hash, ok := r.users[username]
+		if ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return ""
+		}
+		reason = authInvalid
+	}
+	if auth := req.Header.Get("Authorization"); len(r.tokens) > 0 && strings.HasPrefix(auth, "Bearer ") {
+		token := []byte(strings.TrimPrefix(auth, "Bearer "))
+		for _, t := range r.tokens {
+			if subtle.ConstantTimeCompare(t, token) == 1 {
+				return ""
+			}
+		}
+		reason = authInvalid
+	}
+	return reason
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("s3cr3t-token\n"), 0600))
+	config := []EndpointAuth{
+		{
+			Endpoints:  []string{"/_status/vars"},
+			Users:      []BasicUser{{Username: "prometheus", PasswordHash: string(hash)}},
+			TokenFiles: []string{tokenFile},
+		},
+		{
+			Endpoints: []string{"/statement/"},
+			Clients:   []string{"admin"},
+		},
+	}
+	for _, a := range config {
+		require.NoError(t, a.checkConfig())
+	}
+	auth, err := NewAuthenticator(config)
+	require.NoError(t, err)
+	handler := auth.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(path string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if setup != nil {
+			setup(r)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+	invalid := testutil.ToFloat64(unauthorizedRequests.WithLabelValues("/_status/vars", authInvalid))
+
+	// The endpoints not configured are not protected.
+	assert.Equal(http.StatusOK, serve("/healthz", nil).Code)
+
+	rec := serve("/_status/vars", nil)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	assert.Equal([]string{`Basic realm="metrics-exporter"`, `Bearer realm="metrics-exporter"`},
+		rec.Header().Values("WWW-Authenticate"))
+	assert.Equal(http.StatusOK, serve("/_status/vars", func(r *http.Request) {
+		r.SetBasicAuth("prometheus", "secret")
+	}).Code)
+	assert.Equal(http.StatusUnauthorized, serve("/_status/vars", func(r *http.Request) {
+		r.SetBasicAuth("prometheus", "guess")
+	}).Code)
+	assert.Equal(http.StatusOK, serve("/_status/vars", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer s3cr3t-token")
+	}).Code)
+	assert.Equal(http.StatusUnauthorized, serve("/_status/vars", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer guess")
+	}).Code)
+	assert.Equal(invalid+2,
+		testutil.ToFloat64(unauthorizedRequests.WithLabelValues("/_status/vars", authInvalid)))
+
+	// The client certificate identity.
+	withCert := func(name string) func(r *http.Request) {
+		return func(r *http.Request) {
+			cert := &x509.Certificate{DNSNames: []string{name}}
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			}
+		}
+	}
+	assert.Equal(http.StatusUnauthorized, serve("/statement/123", nil).Code)
+	assert.Equal(http.StatusOK, serve("/statement/123", withCert("admin")).Code)
+	assert.Equal(http.StatusUnauthorized, serve("/statement/123", withCert("prometheus")).Code)
+	// An unverified certificate is ignored.
+	assert.Equal(http.StatusUnauthorized, serve("/statement/123", func(r *http.Request) {
+		withCert("admin")(r)
+		r.TLS.VerifiedChains = nil
+	}).Code)
+}
+
+func TestAuthConfig(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualError(EndpointAuth{}.checkConfig(), "endpoints: The auth endpoints are required")
+	assert.EqualError(EndpointAuth{Endpoints: []string{"/_status/vars", "statement"}}.checkConfig(),
+		`2 problems found:
+  endpoints[1]: Invalid auth endpoint: statement
+  No authentication method configured for /_status/vars, statement`)
+	assert.EqualError(EndpointAuth{Endpoints: []string{"/statement/"}}.checkConfig(),
+		"No authentication method configured for /statement/")
+	assert.EqualError(EndpointAuth{
+		Endpoints: []string{"/_status/vars"},
+		Users:     []BasicUser{{Username: "prometheus", PasswordHash: "secret"}},
+	}.checkConfig(), "users[0].passwordhash: Invalid password hash for user prometheus")
+
+	config := Config{
+		URL:    "http://localhost:8080/_status/vars",
+		Port:   8080,
+		Bucket: BucketConfig{Bins: 10, Startns: 1000},
+		Server: Server{Auth: []EndpointAuth{{Endpoints: []string{"/"}, Clients: []string{"admin"}}}},
+	}
+	assert.EqualError(config.checkConfig(), "server.auth[0].clients: "+
+		"The client certificate authentication requires a server clientauth mode")
+}
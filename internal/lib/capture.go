@@ -0,0 +1,149 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCaptureMaxFiles = 1000
+	capturePrefix          = "scrape-"
+	captureSuffix          = ".prom"
+)
+
+// Recorder writes the upstream scrapes into a rotating on-disk archive.
+// Each scrape is stored in its own file, named after the time of the scrape
+// and its source (the node, or all the targets), so that the files sort in chronological order.
+type Recorder struct {
+	dir      string
+	maxFiles int
+	mu       sync.Mutex
+	files    []string // the captures in the archive, in chronological order
+}
+
+// NewRecorder instantiates a Recorder, creating the capture directory if needed.
+// The captures already in the directory count towards the maximum number of files.
+func NewRecorder(config Capture) (*Recorder, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	maxFiles := config.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultCaptureMaxFiles
+	}
+	files, err := listCaptures(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{
+		dir:      config.Dir,
+		maxFiles: maxFiles,
+		files:    files,
+	}, nil
+}
+
+// Record stores a scrape, removing the oldest ones if the archive is full.
+func (r *Recorder) Record(source string, ts time.Time, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name := fmt.Sprintf("%s%020d-%s%s", capturePrefix, ts.UnixNano(), sanitizePath(source), captureSuffix)
+	var buf bytes.Buffer
+	// The header is a comment, ignored by the parser when the file is replayed.
+	fmt.Fprintf(&buf, "# metrics-exporter capture source=%s timestamp=%s\n",
+		source, ts.UTC().Format(time.RFC3339Nano))
+	buf.Write(data)
+	path := filepath.Join(r.dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	r.files = append(r.files, path)
+	return r.rotate()
+}
+
+// rotate removes the oldest captures, keeping at most maxFiles.
+func (r *Recorder) rotate() error {
+	for len(r.files) > r.maxFiles {
+		log.Tracef("Removing capture %s", r.files[0])
+		if err := os.Remove(r.files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		r.files = r.files[1:]
+	}
+	return nil
+}
+
+// listCaptures returns the captures in the directory, in chronological order.
+func listCaptures(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), capturePrefix) &&
+			strings.HasSuffix(e.Name(), captureSuffix) {
+			res = append(res, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Replayer returns the scrapes recorded in a capture directory, or the files
+// matching a glob pattern, in order. It starts over once all the files have been returned.
+type Replayer struct {
+	files []string
+	mu    sync.Mutex
+	next  int
+}
+
+// NewReplayer instantiates a Replayer for the captures in the given directory,
+// or for the files matching the given glob pattern, sorted by name.
+func NewReplayer(pattern string) (*Replayer, error) {
+	var files []string
+	var err error
+	if info, statErr := os.Stat(pattern); statErr == nil && info.IsDir() {
+		files, err = listCaptures(pattern)
+	} else {
+		files, err = filepath.Glob(pattern)
+		sort.Strings(files)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("No captures found in " + pattern)
+	}
+	log.Infof("Replaying %d captures from %s", len(files), pattern)
+	return &Replayer{files: files}, nil
+}
+
+// ReadMetrics returns the metrics from the next capture.
+func (p *Replayer) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	p.mu.Lock()
+	file := p.files[p.next]
+	p.next = (p.next + 1) % len(p.files)
+	if p.next == 0 {
+		log.Info("Last capture reached, replay will start over")
+	}
+	p.mu.Unlock()
+	log.Debugf("Replaying %s", file)
+	return parseFile(file)
+}
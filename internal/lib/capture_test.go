@@ -0,0 +1,118 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureAndReplay(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	recorder, err := NewRecorder(Capture{Dir: dir, MaxFiles: 2})
+	require.NoError(t, err)
+	start := time.Unix(1600000000, 0)
+	for i, v := range []string{"1", "2", "3"} {
+		require.NoError(t, recorder.Record("localhost:8080", start.Add(time.Duration(i)*time.Second),
+			[]byte("# TYPE test gauge\ntest "+v+"\n")))
+	}
+	files, err := listCaptures(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.True(strings.HasPrefix(string(data),
+		"# metrics-exporter capture source=localhost:8080 timestamp=2020-09-13T12:26:41Z\n"))
+
+	replayer, err := NewReplayer(dir)
+	require.NoError(t, err)
+	for _, expected := range []float64{2, 3, 2} {
+		mfs, err := replayer.ReadMetrics(context.Background())
+		require.NoError(t, err)
+		assert.Equal(expected, mfs["test"].Metric[0].GetGauge().GetValue())
+	}
+}
+
+func TestReaderRecordsScrapes(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(input))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	recorder, err := NewRecorder(Capture{Dir: dir})
+	require.NoError(t, err)
+	reader, err := CreateMetricsReader(&Config{URL: upstream.URL}, &http.Transport{})
+	require.NoError(t, err)
+	reader.Recorder = recorder
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, mfs, 1)
+
+	replayer, err := NewReplayer(dir)
+	require.NoError(t, err)
+	replayed, err := replayer.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, mfs, replayed)
+
+	_, err = NewReplayer(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestReaderRecordsMergedScrapes(t *testing.T) {
+	assert := assert.New(t)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns 1\n"))
+	}))
+	defer node.Close()
+	dir := t.TempDir()
+	recorder, err := NewRecorder(Capture{Dir: dir, MaxFiles: 2})
+	require.NoError(t, err)
+	config := &Config{
+		Targets: []Target{
+			{URL: node.URL, Labels: map[string]string{"node": "1"}},
+			{URL: node.URL, Labels: map[string]string{"node": "2"}},
+		},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	reader.Recorder = recorder
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+
+	// A single capture holds all the targets, with their labels.
+	files, err := listCaptures(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	replayer, err := NewReplayer(dir)
+	require.NoError(t, err)
+	replayed, err := replayer.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	require.Len(t, replayed["sql_conns"].Metric, 2)
+	assert.Equal(len(mfs), len(replayed))
+
+	// The captures already in the directory are rotated too.
+	recorder, err = NewRecorder(Capture{Dir: dir, MaxFiles: 2})
+	require.NoError(t, err)
+	reader.Recorder = recorder
+	for i := 0; i < 2; i++ {
+		_, err = reader.ReadMetrics(context.Background())
+		require.NoError(t, err)
+	}
+	remaining, err := listCaptures(dir)
+	require.NoError(t, err)
+	require.Len(t, remaining, 2)
+	assert.NotContains(remaining, files[0])
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certCheckInterval is how often, at most, the certificate files are checked for changes.
+// They are checked during the TLS handshakes, so that rotated certificates are used for
+// the new connections.
+var certCheckInterval = 10 * time.Second
+
+// fileWatch detects the changes of a set of files, from their modification times.
+type fileWatch struct {
+	files     []string
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// lastModified returns the latest modification time of the files.
+func (w *fileWatch) lastModified() time.Time {
+	var res time.Time
+	for _, file := range w.files {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(res) {
+			res = info.ModTime()
+		}
+	}
+	return res
+}
+
+// changed returns true if the files changed since they were loaded. The files
+// are checked at most every certCheckInterval.
+func (w *fileWatch) changed() bool {
+	if time.Since(w.checkedAt) < certCheckInterval {
+		return false
+	}
+	w.checkedAt = time.Now()
+	return !w.lastModified().Equal(w.modTime)
+}
+
+// keyPair is a certificate and its private key, reloaded when the files change.
+type keyPair struct {
+	mu    sync.Mutex
+	watch fileWatch
+	cert  *tls.Certificate
+}
+
+func loadKeyPair(certFile, keyFile string) (*keyPair, error) {
+	k := &keyPair{watch: fileWatch{files: []string{certFile, keyFile}}}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *keyPair) load() error {
+	modTime := k.watch.lastModified()
+	cert, err := tls.LoadX509KeyPair(k.watch.files[0], k.watch.files[1])
+	if err != nil {
+		return err
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	k.cert, k.watch.modTime, k.watch.checkedAt = &cert, modTime, time.Now()
+	certificateExpiry.WithLabelValues(k.watch.files[0]).Set(float64(cert.Leaf.NotAfter.Unix()))
+	return nil
+}
+
+// get returns the certificate, reloading it if the files changed. If the new
+// files cannot be loaded (e.g. they are being replaced), the current certificate is returned.
+func (k *keyPair) get() *tls.Certificate {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.watch.changed() {
+		if err := k.load(); err != nil {
+			log.Errorf("Error reloading %s, keeping the current certificate: %v", k.watch.files[0], err)
+		} else {
+			log.Infof("Reloaded %s", k.watch.files[0])
+		}
+	}
+	return k.cert
+}
+
+// caBundle is a set of CA certificates, reloaded when the file changes.
+type caBundle struct {
+	mu    sync.Mutex
+	watch fileWatch
+	pool  *x509.CertPool
+}
+
+func loadCABundle(file string) (*caBundle, error) {
+	b := &caBundle{watch: fileWatch{files: []string{file}}}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *caBundle) load() error {
+	modTime := b.watch.lastModified()
+	data, err := os.ReadFile(b.watch.files[0])
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	var expiry time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pool.AddCert(cert)
+		if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+	if expiry.IsZero() {
+		return errors.New("No CA certificate found in " + b.watch.files[0])
+	}
+	b.pool, b.watch.modTime, b.watch.checkedAt = pool, modTime, time.Now()
+	certificateExpiry.WithLabelValues(b.watch.files[0]).Set(float64(expiry.Unix()))
+	return nil
+}
+
+// get returns the CA certificates, reloading them if the file changed.
+func (b *caBundle) get() *x509.CertPool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.watch.changed() {
+		if err := b.load(); err != nil {
+			log.Errorf("Error reloading %s, keeping the current CA: %v", b.watch.files[0], err)
+		} else {
+			log.Infof("Reloaded %s", b.watch.files[0])
+		}
+	}
+	return b.pool
+}
+
+// dialTLS returns the function that opens the TLS connections to the servers.
+// The server certificate is verified with the current CA certificates, against the
+// host dialed (a DNS name, or an IP address), unless the base configuration sets
+// a server name (the host of the TLS configuration).
+func (b *caBundle) dialTLS(base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := base.Clone()
+		config.RootCAs = b.get()
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			config.ServerName = host
+		}
+		dialer := &tls.Dialer{Config: config}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
@@ -11,11 +11,16 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"math"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -23,25 +28,289 @@ import (
 // Config has the configuration for the metrics-exporter
 // * Bucket: Log10 Bucket Configuration
 // * Port: Port that the export is listening to
-// * Tls: optional Tls configuration
+// * Tls: optional Tls configuration, used for both the upstream connections and the exporter
+// endpoints, unless overridden by the upstream and server sections
+// * Server: optional TLS configuration of the exporter endpoints
 // * Url: CockroachDB Prometheus endpoint
+// * Session: optional login to the CockroachDB HTTP API, using a SQL user
+// * Targets: optional list of CockroachDB Prometheus endpoints, scraped concurrently
+// * Parallelism: max number of concurrent scrapes, when there are multiple targets
+// * Upstream: optional retry, circuit breaker and stale-serving settings for the scrapes
+// * Scrape: optional timeout settings for the requests to the exporter
+// * CacheTTL: how long the translated metrics are cached, and served to concurrent scrapers
+// * Discovery: optional discovery of the nodes to scrape
+// * Tenants: optional virtual clusters to scrape
+// * Custom: optional custom metrics configuration
+// * RemoteWrite: optional Prometheus remote write configuration
+// * OTLP: optional OpenTelemetry push configuration
+// * Graphite: optional Graphite/StatsD push configuration
+// * Influx: optional InfluxDB push configuration
+// * Capture: optional recording of the raw upstream scrapes
+// * ShutdownGrace: max time to complete the in-flight requests and stop, default 15s
+// * ReloadInterval: how often the configuration file is checked for changes, default 10s
 type Config struct {
-	Bucket BucketConfig
-	Port   int
-	TLS    TLSConfig `yaml:"tls,omitempty"`
-	URL    string
-	Custom Custom `yaml:"custom,omitempty"`
+	Bucket      BucketConfig
+	Port        int
+	TLS         TLSConfig `yaml:"tls,omitempty"`
+	Server      Server    `yaml:"server,omitempty"`
+	URL         string
+	Session     Session       `yaml:"session,omitempty"`
+	Targets     []Target      `yaml:"targets,omitempty"`
+	Parallelism int           `yaml:"parallelism,omitempty"`
+	Upstream    Upstream      `yaml:"upstream,omitempty"`
+	CacheTTL    time.Duration `yaml:"cachettl,omitempty"`
+	Scrape      Scrape        `yaml:"scrape,omitempty"`
+	Discovery   Discovery     `yaml:"discovery,omitempty"`
+	Tenants     Tenants       `yaml:"tenants,omitempty"`
+	Custom      Custom        `yaml:"custom,omitempty"`
+	RemoteWrite RemoteWrite   `yaml:"remotewrite,omitempty"`
+	OTLP        OTLP          `yaml:"otlp,omitempty"`
+	Graphite    Graphite      `yaml:"graphite,omitempty"`
+	Influx      Influx        `yaml:"influx,omitempty"`
+	Capture     Capture       `yaml:"capture,omitempty"`
+
+	ShutdownGrace  time.Duration `yaml:"shutdowngrace,omitempty"`
+	ReloadInterval time.Duration `yaml:"reloadinterval,omitempty"`
 }
 
 func (c Config) checkConfig() error {
-	_, err := url.ParseRequestURI(c.URL)
-	if err != nil {
-		return err
+	return c.check(false)
+}
+
+// check validates the configuration. The offline subcommands (e.g. convert) do not
+// read from the upstream endpoints, nor listen on the port: their settings are not checked.
+func (c Config) check(offline bool) error {
+	var errs ConfigErrors
+	if !offline {
+		if c.URL != "" || len(c.Targets) == 0 {
+			_, err := url.ParseRequestURI(c.URL)
+			errs.add("url", err)
+		}
+		for i, t := range c.Targets {
+			_, err := url.ParseRequestURI(t.URL)
+			errs.add(fmt.Sprintf("targets[%d].url", i), err)
+		}
+	}
+	if c.Parallelism < 0 {
+		errs.add("parallelism", errors.New("Invalid parallelism"))
+	}
+	if c.CacheTTL < 0 {
+		errs.add("cachettl", errors.New("Invalid cache ttl"))
+	}
+	if c.ShutdownGrace < 0 {
+		errs.add("shutdowngrace", errors.New("Invalid shutdown grace period"))
+	}
+	if c.ReloadInterval < 0 {
+		errs.add("reloadinterval", errors.New("Invalid reload interval"))
+	}
+	if c.Scrape.Timeout < 0 || c.Scrape.Margin < 0 {
+		errs.add("scrape", errors.New("Invalid scrape timeout"))
+	} else if c.Scrape.Timeout > 0 && c.Scrape.Margin >= c.Scrape.Timeout {
+		errs.add("scrape.margin", fmt.Errorf("The margin (%s) must be less than the timeout (%s)",
+			c.Scrape.Margin, c.Scrape.Timeout))
+	}
+	if !offline && (c.Port < 1024 || c.Port > 65535) {
+		errs.add("port", errors.New("Invalid port range"))
+	}
+	errs.add("bucket", c.Bucket.checkConfig())
+	if !offline {
+		errs.add("upstream", c.Upstream.checkConfig())
+	}
+	errs.add("server", c.Server.checkConfig())
+	for i, a := range c.Server.Auth {
+		if s := c.ServerTLS(); len(a.Clients) > 0 &&
+			(s == nil || s.ClientAuth == "" || s.ClientAuth == ClientAuthNone) {
+			errs.add(fmt.Sprintf("server.auth[%d].clients", i),
+				errors.New("The client certificate authentication requires a server clientauth mode"))
+		}
+	}
+	if c.HasSession() {
+		errs.add("session", c.Session.checkConfig())
+	}
+	if c.HasDiscovery() {
+		if len(c.Targets) > 0 {
+			errs.add("targets", errors.New("The targets cannot be listed when the nodes are discovered"))
+		}
+		errs.add("discovery", c.Discovery.checkConfig(c))
+	}
+	if c.HasTenants() {
+		errs.add("tenants", c.Tenants.checkConfig(c))
+	}
+	errs.add("custom", c.Custom.checkConfig())
+	for i, e := range c.RemoteWrite.Endpoints {
+		errs.add(fmt.Sprintf("remotewrite.endpoints[%d]", i), e.checkConfig())
+	}
+	if c.HasOTLP() {
+		errs.add("otlp", c.OTLP.checkConfig())
+	}
+	if c.HasGraphite() {
+		errs.add("graphite", c.Graphite.checkConfig())
+	}
+	if c.HasInflux() {
+		errs.add("influx", c.Influx.checkConfig())
+	}
+	return errs.err()
+}
+
+// Target is a CockroachDB Prometheus endpoint.
+// * URL: the endpoint URL
+// * TLS: optional TLS configuration, overriding the top level one
+// * Labels: labels added to every series scraped from the target
+type Target struct {
+	URL    string
+	TLS    *TLSConfig `yaml:"tls,omitempty"`
+	Labels map[string]string
+}
+
+// Scrape provides the configuration of the deadline to respond to a scrape.
+// * Timeout: used if the scraper does not send the X-Prometheus-Scrape-Timeout-Seconds header. Default 10s.
+// * Margin: subtracted from the timeout, to respond before the scraper gives up. Default 500ms.
+type Scrape struct {
+	Timeout time.Duration
+	Margin  time.Duration
+}
+
+// Session provides the credentials of the SQL user that logs in to the
+// CockroachDB HTTP API (/_admin/v1/login). The session cookie is added to all the
+// requests, and a new session is created when the current one is rejected.
+// * Username: the SQL user, or UsernameFile / UsernameEnv to read it from a file or an environment variable
+// * PasswordFile / PasswordEnv: the file or the environment variable with the password
+type Session struct {
+	Username     string
+	UsernameFile string
+	UsernameEnv  string
+	PasswordFile string
+	PasswordEnv  string
+}
+
+func (s Session) checkConfig() error {
+	var errs ConfigErrors
+	if s.Username == "" && s.UsernameFile == "" && s.UsernameEnv == "" {
+		errs.add("username", errors.New("The session username is required"))
+	}
+	if s.PasswordFile == "" && s.PasswordEnv == "" {
+		errs.add("passwordfile", errors.New("The session password file or environment variable is required"))
+	}
+	return errs.err()
+}
+
+// Tenants provides the configuration to scrape the metrics of the virtual clusters
+// (tenants) running in the nodes. The virtual cluster is selected with the
+// X-Cockroach-Tenant header, and the tenant label is added to every series.
+// * Names: the virtual clusters to scrape
+// * Discover: list the virtual clusters with SHOW VIRTUAL CLUSTERS, using the connection
+// in the custom section. Only the ready virtual clusters in shared service mode are scraped.
+// * Interval: how often the list of virtual clusters is refreshed, default 1m
+type Tenants struct {
+	Names    []string
+	Discover bool
+	Interval time.Duration
+}
+
+func (t Tenants) checkConfig(c Config) error {
+	var errs ConfigErrors
+	if t.Discover && !c.HasCustom() {
+		errs.add("discover", errors.New("The custom section is required to discover the virtual clusters"))
+	}
+	if t.Interval < 0 {
+		errs.add("interval", errors.New("Invalid tenants interval"))
+	}
+	for i, name := range t.Names {
+		if name == "" {
+			errs.add(fmt.Sprintf("names[%d]", i), errors.New("Invalid empty tenant name"))
+		}
+	}
+	return errs.err()
+}
+
+// Upstream provides the configuration to read the metrics from the targets.
+// * Timeout: max time to scrape a target, including the retries. Default 10s.
+// * MaxRetries: max number of retries, default 2. Set to -1 to disable the retries.
+// * MinBackoff, MaxBackoff: bounds of the jittered exponential backoff between retries,
+// default 100ms and 2s.
+// * FailureThreshold: number of consecutive failed scrapes that open the circuit breaker
+// of a target, default 5. While the breaker is open the target is not scraped.
+// * Cooldown: how long the breaker stays open before a new scrape is attempted, default 30s.
+// * StaleFor: if set, the last good scrape of a target is served, for at most this long,
+// when the target cannot be scraped.
+// * TLS: optional TLS configuration to connect to the targets, overriding the top level one.
+type Upstream struct {
+	TLS              *TLSConfig `yaml:"tls,omitempty"`
+	Timeout          time.Duration
+	MaxRetries       int
+	MinBackoff       time.Duration
+	MaxBackoff       time.Duration
+	FailureThreshold int
+	Cooldown         time.Duration
+	StaleFor         time.Duration
+}
+
+func (u Upstream) checkConfig() error {
+	var errs ConfigErrors
+	for _, d := range []struct {
+		path  string
+		value time.Duration
+	}{
+		{"timeout", u.Timeout},
+		{"minbackoff", u.MinBackoff},
+		{"maxbackoff", u.MaxBackoff},
+		{"cooldown", u.Cooldown},
+		{"stalefor", u.StaleFor},
+	} {
+		if d.value < 0 {
+			errs.add(d.path, fmt.Errorf("Invalid upstream duration %s", d.value))
+		}
+	}
+	if u.MaxRetries < -1 {
+		errs.add("maxretries", errors.New("Invalid upstream max retries"))
+	}
+	if u.FailureThreshold < 0 {
+		errs.add("failurethreshold", errors.New("Invalid upstream failure threshold"))
+	}
+	if u.MaxBackoff > 0 && u.MinBackoff > u.MaxBackoff {
+		errs.add("minbackoff", errors.New("Upstream min backoff is greater than max backoff"))
+	}
+	return errs.err()
+}
+
+// Discovery provides the configuration to discover the live nodes of the cluster,
+// and scrape each one of them.
+// * Source: http, to use the /_status/nodes API of the node at the url, or sql,
+// to query crdb_internal.gossip_nodes using the connection in the custom section.
+// * Interval: how often the list of nodes is refreshed, default 1m
+// * Scheme: scheme of the metrics endpoints, defaults to the scheme of the url
+// * Path: path of the metrics endpoints, defaults to /_status/vars
+// * HTTPPort: port of the HTTP endpoints, used with the sql source, since gossip_nodes
+// only reports the RPC address. Default 8080.
+type Discovery struct {
+	Source   string
+	Interval time.Duration
+	Scheme   string
+	Path     string
+	HTTPPort int
+}
+
+func (d Discovery) checkConfig(c Config) error {
+	var errs ConfigErrors
+	switch d.Source {
+	case HTTPDiscovery:
+		if c.URL == "" {
+			errs.add("source", errors.New("The url is required for http discovery"))
+		}
+	case SQLDiscovery:
+		if c.Custom.URL == "" {
+			errs.add("source", errors.New("The custom url is required for sql discovery"))
+		}
+	default:
+		errs.add("source", errors.New("Invalid discovery source: "+d.Source))
+	}
+	if d.Interval < 0 {
+		errs.add("interval", errors.New("Invalid discovery interval"))
 	}
-	if c.Port < 1024 || c.Port > 65535 {
-		return errors.New("Invalid port range")
+	if d.HTTPPort < 0 || d.HTTPPort > 65535 {
+		errs.add("httpport", errors.New("Invalid discovery http port"))
 	}
-	return c.Bucket.checkConfig()
+	return errs.err()
 }
 
 // BucketConfig defines the config parameters for each histogram bucket
@@ -50,7 +319,7 @@ func (c Config) checkConfig() error {
 // * Endns: Optional upper range
 // * Exclude: Regex of histogram names to exclude
 // * Include: Regex of histogram names to include, regardless of the exclude settings
-// * Unit: Time unit to use for the log10 buckets
+// * Unit: Time unit to use for the log10 buckets: nanoseconds (default), microseconds, milliseconds or seconds
 type BucketConfig struct {
 	Bins    int
 	Startns int
@@ -61,26 +330,29 @@ type BucketConfig struct {
 	Unit    string
 }
 
+// bucketUnits maps the units of the buckets to their size in nanoseconds.
+var bucketUnits = map[string]float64{
+	"":             1,
+	"nanoseconds":  1,
+	"microseconds": math.Pow10(3),
+	"milliseconds": math.Pow10(6),
+	"seconds":      math.Pow10(9),
+}
+
+var bucketUnitNames = []string{"nanoseconds", "microseconds", "milliseconds", "seconds"}
+
 // UnitDiv converts time units into nano secods
 func (b *BucketConfig) UnitDiv() float64 {
-	var div float64 = 1
-	if b.Unit != "" {
-		switch b.Unit {
-		case "seconds":
-			div = math.Pow10(9)
-		case "milliseconds":
-			div = math.Pow10(6)
-		case "microseconds":
-			div = math.Pow10(3)
-		}
+	if div, ok := bucketUnits[b.Unit]; ok {
+		return div
 	}
-	return div
+	return 1
 }
 
 // TLSConfig  Configuration
 // * Ca: CA certificate file location
 // * Certificate: X.509 certificate for the server
-// * Host: Host name associated with X.509 certificate.
+// * Host: Host name associated with X.509 certificate, verified instead of the host dialed.
 // * PrivateKey: Server private key
 type TLSConfig struct {
 	Ca          string
@@ -89,15 +361,78 @@ type TLSConfig struct {
 	PrivateKey  string
 }
 
-// TLSClientContext is the context for TLS connections.
-type TLSClientContext struct {
-	CertPool    *x509.CertPool
-	Certificate tls.Certificate
+// Client authentication modes of the exporter endpoints.
+const (
+	ClientAuthNone             = "none"
+	ClientAuthRequest          = "request"
+	ClientAuthRequireAndVerify = "require-and-verify"
+)
+
+// Server provides the configuration of the exporter endpoints.
+// * TLS: optional TLS configuration, overriding the top level one.
+// * Auth: optional authentication of the endpoints
+type Server struct {
+	TLS  *ServerTLS     `yaml:"tls,omitempty"`
+	Auth []EndpointAuth `yaml:"auth,omitempty"`
+}
+
+func (s Server) checkConfig() error {
+	var errs ConfigErrors
+	if s.TLS != nil {
+		errs.add("tls", s.TLS.checkConfig())
+	}
+	for i, a := range s.Auth {
+		errs.add(fmt.Sprintf("auth[%d]", i), a.checkConfig())
+	}
+	return errs.err()
+}
+
+// ServerTLS is the TLS configuration of the exporter endpoints.
+// * Ca: CA certificate file location, to verify the client certificates
+// * Certificate: X.509 certificate of the exporter
+// * PrivateKey: private key of the exporter
+// * ClientAuth: none (default), request (the client certificate is verified, if sent),
+// or require-and-verify
+// * AllowedClients: optional common names or subject alternative names (DNS names, IP addresses,
+// emails or URIs) of the client certificates that are accepted; requires require-and-verify.
+type ServerTLS struct {
+	Ca             string
+	Certificate    string
+	PrivateKey     string
+	ClientAuth     string   `yaml:"clientauth,omitempty"`
+	AllowedClients []string `yaml:"allowedclients,omitempty"`
 }
 
-// Custom provides the configuration to retrieve custom metrics
+func (s *ServerTLS) checkConfig() error {
+	var errs ConfigErrors
+	if s.Certificate == "" {
+		errs.add("certificate", errors.New("The server certificate is required"))
+	}
+	if s.PrivateKey == "" {
+		errs.add("privatekey", errors.New("The server private key is required"))
+	}
+	switch s.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthRequest, ClientAuthRequireAndVerify:
+		if s.Ca == "" {
+			errs.add("ca", errors.New("A CA is required to verify the client certificates"))
+		}
+	default:
+		errs.add("clientauth", errors.New("Invalid client auth mode: "+s.ClientAuth))
+	}
+	if len(s.AllowedClients) > 0 && s.ClientAuth != ClientAuthRequireAndVerify {
+		errs.add("allowedclients", errors.New("The allowed clients require the require-and-verify client auth mode"))
+	}
+	return errs.err()
+}
+
+// Custom provides the configuration to retrieve custom metrics.
+// PasswordFile / PasswordEnv: the file or the environment variable with the password
+// of the SQL user, if not in the URL.
 type Custom struct {
 	URL                 string
+	PasswordFile        string
+	PasswordEnv         string
 	DisableGetStatement bool
 	Limit               int
 	SkipActivity        bool
@@ -106,28 +441,323 @@ type Custom struct {
 	Endpoint            string
 }
 
-// ReadConfig reads yaml configuration from a file
+func (c Custom) checkConfig() error {
+	var errs ConfigErrors
+	if c.Limit < 0 {
+		errs.add("limit", errors.New("Invalid limit"))
+	}
+	if c.Frequency < 0 {
+		errs.add("frequency", errors.New("Invalid frequency"))
+	}
+	if c.Endpoint != "" && !strings.HasPrefix(c.Endpoint, "/") {
+		errs.add("endpoint", errors.New("The endpoint must start with /"))
+	}
+	return errs.err()
+}
+
+// RemoteWrite provides the configuration to push metrics using the
+// Prometheus remote write protocol.
+// * Interval: how often the metrics are collected and pushed
+// * Endpoints: the remote write receivers
+type RemoteWrite struct {
+	Interval  time.Duration
+	Endpoints []PushEndpoint
+}
+
+// PushEndpoint is a remote endpoint the metrics are pushed to.
+// * URL: the endpoint URL
+// * Timeout: timeout for each request
+// * QueueSize: max number of pending payloads; the oldest are dropped when full.
+// * MaxRetries: max number of retries for recoverable errors, default 3. Set to -1 to disable the retries.
+// * Headers: additional HTTP headers
+type PushEndpoint struct {
+	URL         string
+	Timeout     time.Duration
+	QueueSize   int
+	MaxRetries  int
+	Headers     map[string]string
+	Credentials `yaml:",inline"`
+}
+
+// OTLP provides the configuration to push metrics to an OpenTelemetry collector,
+// using OTLP/HTTP with protobuf encoding.
+// * Interval: how often the metrics are collected and pushed
+// * Endpoint settings: URL (e.g. http://collector:4318/v1/metrics), timeout, queue, retries, credentials
+// * Cluster: value of the cluster resource attribute
+// * Node: value of the node resource attribute, defaults to the host of the CockroachDB URL
+// * Attributes: additional resource attributes
+// * ExponentialHistograms: convert HDR histograms into exponential histograms,
+// rather than into log10 linear histograms.
+// * Scale: the scale of the exponential histograms, from -10 to 20 (default 3)
+type OTLP struct {
+	Interval              time.Duration
+	PushEndpoint          `yaml:",inline"`
+	Cluster               string
+	Node                  string
+	Attributes            map[string]string
+	ExponentialHistograms bool
+	Scale                 *int
+}
+
+func (o OTLP) checkConfig() error {
+	var errs ConfigErrors
+	if o.Interval < 0 {
+		errs.add("interval", errors.New("Invalid OTLP interval"))
+	}
+	if o.Scale != nil && (*o.Scale < -10 || *o.Scale > 20) {
+		errs.add("scale", errors.New("Invalid OTLP exponential histogram scale"))
+	}
+	errs.add("", o.PushEndpoint.checkConfig())
+	return errs.err()
+}
+
+// Graphite provides the configuration to push metrics to Graphite, using the
+// plaintext protocol over TCP, or to StatsD as gauges over UDP.
+// * Address: host:port of the server
+// * Protocol: graphite (default) or statsd
+// * Interval: how often the metrics are collected and pushed
+// * Timeout: timeout to connect and send the metrics
+// * Prefix: optional prefix for all the paths
+// * Labels: labels whose values, in order, are appended to the path.
+// If empty, all the labels are appended as name.value, sorted by name.
+// * Histograms: buckets (default), to send one path per bucket, or quantiles
+// * Quantiles: the quantiles computed for histograms, default 0.5, 0.9, 0.99
+type Graphite struct {
+	Address    string
+	Protocol   string
+	Interval   time.Duration
+	Timeout    time.Duration
+	Prefix     string
+	Labels     []string
+	Histograms string
+	Quantiles  []float64
+}
+
+func (g Graphite) checkConfig() error {
+	var errs ConfigErrors
+	if _, _, err := net.SplitHostPort(g.Address); err != nil {
+		errs.add("address", err)
+	}
+	switch g.Protocol {
+	case "", GraphiteProtocol, StatsDProtocol:
+	default:
+		errs.add("protocol", errors.New("Invalid graphite protocol: "+g.Protocol))
+	}
+	if g.Interval < 0 || g.Timeout < 0 {
+		errs.add("interval", errors.New("Invalid graphite duration"))
+	}
+	switch g.Histograms {
+	case "", GraphiteBuckets, GraphiteQuantiles:
+	default:
+		errs.add("histograms", errors.New("Invalid graphite histograms mode: "+g.Histograms))
+	}
+	for i, q := range g.Quantiles {
+		if q < 0 || q > 1 {
+			errs.add(fmt.Sprintf("quantiles[%d]", i), fmt.Errorf("Invalid graphite quantile %g", q))
+		}
+	}
+	return errs.err()
+}
+
+// Influx provides the configuration to push metrics to an InfluxDB compatible
+// HTTP write API, using the line protocol.
+// * Interval: how often the metrics are collected and pushed
+// * Endpoint settings: URL (e.g. http://influx:8086/api/v2/write?org=my-org&bucket=crdb),
+// timeout, queue, retries, credentials. The bearer token is sent using the Token scheme, by default.
+type Influx struct {
+	Interval     time.Duration
+	PushEndpoint `yaml:",inline"`
+}
+
+// Capture provides the configuration to record every raw upstream scrape
+// into a rotating on-disk archive, that can be replayed later.
+// * Dir: the directory where the scrapes are stored
+// * MaxFiles: the number of scrapes to keep; the oldest are removed. Default 1000.
+type Capture struct {
+	Dir      string
+	MaxFiles int
+}
+
+// Credentials to authenticate to a remote endpoint, either basic or bearer auth.
+// Passwords and tokens can be read from files, to support secret rotation.
+// TokenScheme is the authorization scheme used for the token, Bearer by default.
+type Credentials struct {
+	Username        string
+	Password        string
+	PasswordFile    string
+	BearerToken     string
+	BearerTokenFile string
+	TokenScheme     string
+}
+
+func (e PushEndpoint) checkConfig() error {
+	var errs ConfigErrors
+	if _, err := url.ParseRequestURI(e.URL); err != nil {
+		errs.add("url", err)
+	}
+	if e.Timeout < 0 {
+		errs.add("timeout", errors.New("Invalid timeout"))
+	}
+	if e.MaxRetries < -1 {
+		errs.add("maxretries", errors.New("Invalid max retries"))
+	}
+	if (e.BearerToken != "" || e.BearerTokenFile != "") && e.Username != "" {
+		errs.add("bearertoken", errors.New("Only one of basic auth or bearer token can be configured"))
+	}
+	return errs.err()
+}
+
+func (i Influx) checkConfig() error {
+	var errs ConfigErrors
+	if i.Interval < 0 {
+		errs.add("interval", errors.New("Invalid influx interval"))
+	}
+	errs.add("", i.PushEndpoint.checkConfig())
+	return errs.err()
+}
+
+// ReadConfig reads yaml configuration from a file. It exits if the configuration is invalid.
 func ReadConfig(configLocation *string) *Config {
-	data, err := os.ReadFile(*configLocation)
+	config, err := LoadConfig(*configLocation)
 	if err != nil {
-		log.Fatal("Error reading configuration at", configLocation, ": ", err)
+		log.Fatal("Error reading configuration: ", Redact(err.Error()))
 	}
+	return config
+}
+
+// LoadConfig reads yaml configuration from a file, applies the overrides from the
+// environment, and validates it. All the problems found are returned, as ConfigErrors.
+func LoadConfig(location string) (*Config, error) {
+	return LoadConfigWithOverrides(location, nil)
+}
+
+// LoadConfigWithOverrides reads yaml configuration from a file, applies the overrides,
+// and validates it. The settings are applied in order of precedence:
+// * overrides: the settings set on the command line, by key (e.g. bucket.startns)
+// * the METRICS_EXPORTER_CONFIG_ environment variables (see EnvName)
+// * the configuration file, after the ${VAR} references are expanded
+// * the defaults
+// Without a location, the configuration is built from the overrides only.
+func LoadConfigWithOverrides(location string, overrides map[string]string) (*Config, error) {
+	return loadConfig(location, overrides, false)
+}
+
+// LoadOfflineConfig is LoadConfigWithOverrides for the subcommands that translate
+// the metrics offline (e.g. convert): the url, targets, port and upstream settings
+// are not required, nor checked.
+func LoadOfflineConfig(location string, overrides map[string]string) (*Config, error) {
+	return loadConfig(location, overrides, true)
+}
+
+func loadConfig(location string, overrides map[string]string, offline bool) (*Config, error) {
 	config := Config{}
-	err = yaml.Unmarshal([]byte(data), &config)
-	if err != nil {
-		log.Fatal("Error reading configuration:", err)
+	var errs ConfigErrors
+	if location != "" {
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return nil, err
+		}
+		data, err = expandEnv(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", location, err)
+		}
+		// The unknown keys are reported with the other problems.
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			var typeErr *yaml.TypeError
+			if !errors.As(err, &typeErr) {
+				return nil, fmt.Errorf("%s: %w", location, err)
+			}
+			for _, msg := range typeErr.Errors {
+				errs.add("", errors.New(msg))
+			}
+		}
 	}
-
-	err = config.checkConfig()
-	if err != nil {
-		log.Fatal("Error reading configuration:", err)
+	errs.add("", config.applyEnv(os.Environ()))
+	keys := make([]string, 0, len(overrides))
+	for key := range overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		errs.add("", config.Set(key, overrides[key]))
+	}
+	errs.add("", config.check(offline))
+	if len(errs) > 0 {
+		if location == "" {
+			return nil, errs
+		}
+		return nil, fmt.Errorf("%s: %w", location, errs)
 	}
-	return &config
+	return &config, nil
 }
 
-// IsSecure returns true if there is a Tls configuration
+// IsSecure returns true if the exporter endpoints are served over TLS.
 func (c *Config) IsSecure() bool {
-	return c.TLS != TLSConfig{}
+	return c.ServerTLS() != nil
+}
+
+// ServerTLS returns the TLS configuration of the exporter endpoints, or nil.
+// Without a server section, the top level tls section is used, without client authentication.
+func (c *Config) ServerTLS() *ServerTLS {
+	if c.Server.TLS != nil {
+		return c.Server.TLS
+	}
+	if c.TLS == (TLSConfig{}) {
+		return nil
+	}
+	return &ServerTLS{
+		Ca:          c.TLS.Ca,
+		Certificate: c.TLS.Certificate,
+		PrivateKey:  c.TLS.PrivateKey,
+	}
+}
+
+// UpstreamTLS returns the TLS configuration to connect to the targets.
+func (c *Config) UpstreamTLS() TLSConfig {
+	if c.Upstream.TLS != nil {
+		return *c.Upstream.TLS
+	}
+	return c.TLS
+}
+
+// HasRemoteWrite returns true if there are remote write endpoints
+func (c *Config) HasRemoteWrite() bool {
+	return len(c.RemoteWrite.Endpoints) > 0
+}
+
+// HasOTLP returns true if there is an OTLP endpoint
+func (c *Config) HasOTLP() bool {
+	return c.OTLP.URL != ""
+}
+
+// HasGraphite returns true if there is a Graphite/StatsD server
+func (c *Config) HasGraphite() bool {
+	return c.Graphite.Address != ""
+}
+
+// HasInflux returns true if there is an InfluxDB endpoint
+func (c *Config) HasInflux() bool {
+	return c.Influx.URL != ""
+}
+
+// HasSession returns true if the exporter logs in to the CockroachDB HTTP API
+func (c *Config) HasSession() bool {
+	return c.Session != Session{}
+}
+
+// HasCapture returns true if the upstream scrapes are recorded
+func (c *Config) HasCapture() bool {
+	return c.Capture.Dir != ""
+}
+
+// HasDiscovery returns true if the nodes to scrape are discovered
+func (c *Config) HasDiscovery() bool {
+	return c.Discovery.Source != ""
+}
+
+// HasTenants returns true if the metrics of the virtual clusters are scraped
+func (c *Config) HasTenants() bool {
+	return c.Tenants.Discover || len(c.Tenants.Names) > 0
 }
 
 // HasCustom returns true if there is a custom section
@@ -135,44 +765,132 @@ func (c *Config) HasCustom() bool {
 	return c.Custom != Custom{}
 }
 
-// GetTLSClientContext builds the Client TLS context
-func (c *Config) GetTLSClientContext() (*TLSClientContext, error) {
-	var cert tls.Certificate
-	var err error
-	if c.TLS.Certificate != "" && c.TLS.PrivateKey != "" {
-		cert, err = tls.LoadX509KeyPair(c.TLS.Certificate, c.TLS.PrivateKey)
+// GetTransport builds the transport to connect to CockroachDB, using
+// the TLS client context if there is a TLS configuration.
+// The certificate, the key and the CA are reloaded when the files change.
+func (t *TLSConfig) GetTransport() (*http.Transport, error) {
+	if *t == (TLSConfig{}) {
+		return &http.Transport{}, nil
+	}
+	ca, err := loadCABundle(t.Ca)
+	if err != nil {
+		return nil, err
+	}
+	var cert *keyPair
+	if t.Certificate != "" && t.PrivateKey != "" {
+		cert, err = loadKeyPair(t.Certificate, t.PrivateKey)
 		if err != nil {
 			return nil, err
 		}
 	}
-	caCert, err := ioutil.ReadFile(c.TLS.Ca)
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	return &TLSClientContext{
-		CertPool:    caCertPool,
-		Certificate: cert,
-	}, err
+	base := &tls.Config{
+		ServerName: t.Host,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert.get(), nil
+		},
+	}
+	// The connections are opened with the current CA certificates.
+	return &http.Transport{DialTLSContext: ca.dialTLS(base)}, nil
 }
 
-// GetTLSServerContext builds the Server TLS context
+// GetTLSServerContext builds the Server TLS context, with the server certificate.
+// The certificate, the key and the CA are reloaded when the files change.
 func (c *Config) GetTLSServerContext() (*tls.Config, error) {
-	caCert, err := ioutil.ReadFile(c.TLS.Ca)
+	s := c.ServerTLS()
+	if s == nil {
+		return nil, errors.New("The server TLS is not configured")
+	}
+	cert, err := loadKeyPair(s.Certificate, s.PrivateKey)
 	if err != nil {
 		return nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
-	return &tls.Config{
-		ServerName: c.TLS.Host,
+	res := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.get(), nil
+		},
 		ClientAuth: tls.NoClientCert,
-		ClientCAs:  caCertPool,
 		MinVersion: tls.VersionTLS12,
-	}, nil
+	}
+	switch s.ClientAuth {
+	case ClientAuthRequest:
+		res.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequireAndVerify:
+		res.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if len(s.AllowedClients) > 0 {
+		res.VerifyConnection = allowedClients(s.AllowedClients)
+	}
+	if s.Ca != "" {
+		ca, err := loadCABundle(s.Ca)
+		if err != nil {
+			return nil, err
+		}
+		base := res.Clone()
+		res.ClientCAs = ca.get()
+		// Using the current CA to verify the client certificates.
+		res.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := base.Clone()
+			config.ClientCAs = ca.get()
+			return config, nil
+		}
+	}
+	return res, nil
+}
+
+// allowedClients returns a function that rejects the connections if the client
+// certificate has none of the names as common name or subject alternative name.
+func allowedClients(names []string) func(tls.ConnectionState) error {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("A client certificate is required")
+		}
+		cert := cs.PeerCertificates[0]
+		for _, name := range certificateNames(cert) {
+			if allowed[name] {
+				return nil
+			}
+		}
+		return fmt.Errorf("The client certificate %q is not allowed", cert.Subject.CommonName)
+	}
+}
+
+// certificateNames returns the common name and the subject alternative names of a certificate.
+func certificateNames(cert *x509.Certificate) []string {
+	res := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	res = append(res, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		res = append(res, ip.String())
+	}
+	for _, u := range cert.URIs {
+		res = append(res, u.String())
+	}
+	return res
 }
 
 func (b *BucketConfig) checkConfig() error {
-	if b.Bins >= 1 && b.Bins <= 100 && b.Startns >= 1 {
-		return nil
+	var errs ConfigErrors
+	if b.Bins < 1 || b.Bins > 100 {
+		errs.add("bins", fmt.Errorf("The number of bins (%d) must be between 1 and 100", b.Bins))
+	}
+	if b.Startns < 1 {
+		errs.add("startns", fmt.Errorf("The lower range (%d) must be at least 1ns", b.Startns))
+	}
+	if b.Endns < 0 || (b.Endns > 0 && b.Endns <= b.Startns) {
+		errs.add("endns", fmt.Errorf("The upper range (%d) must be greater than the lower range (%d)",
+			b.Endns, b.Startns))
+	}
+	if _, ok := bucketUnits[b.Unit]; !ok {
+		errs.add("unit", fmt.Errorf("Invalid unit %q, the valid units are %s",
+			b.Unit, strings.Join(bucketUnitNames, ", ")))
 	}
-	return errors.New("Invalid Bucket Configuration")
+	errs.add("exclude", checkRegex(b.Exclude))
+	errs.add("include", checkRegex(b.Include))
+	return errs.err()
 }
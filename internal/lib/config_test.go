@@ -0,0 +1,125 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+	location := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(location, []byte(`
+url: http://localhost:8080/_status/vars
+port: 80
+bucket:
+  startns: 1000
+  endns: 100
+  bins: 10
+  unit: millseconds
+  exclude: sql_[
+targets:
+  - url: localhost
+custom:
+  url: postgresql://root@localhost:26257
+  frequncy: 10
+`), 0600))
+	_, err := LoadConfig(location)
+	var errs ConfigErrors
+	require.True(t, errors.As(err, &errs))
+	assert.Equal(location+`: 6 problems found:
+  line 14: field frequncy not found in type lib.Custom
+  targets[0].url: parse "localhost": invalid URI for request
+  port: Invalid port range
+  bucket.endns: The upper range (100) must be greater than the lower range (1000)
+  bucket.unit: Invalid unit "millseconds", the valid units are nanoseconds, microseconds, milliseconds, seconds
+  bucket.exclude: Invalid regex "sql_[": missing closing ] at offset 4, near "["`, err.Error())
+
+	// A syntax error is reported alone.
+	require.NoError(t, os.WriteFile(location, []byte("port: [8080\n"), 0600))
+	_, err = LoadConfig(location)
+	assert.Error(err)
+	assert.False(errors.As(err, &errs))
+
+	require.NoError(t, os.WriteFile(location, []byte(`
+url: http://localhost:8080/_status/vars
+port: 8080
+bucket:
+  startns: 1000
+  bins: 10
+  unit: milliseconds
+`), 0600))
+	config, err := LoadConfig(location)
+	require.NoError(t, err)
+	assert.Equal(1e6, config.Bucket.UnitDiv())
+}
+
+func TestConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+	var errs ConfigErrors
+	errs.add("server", nil)
+	assert.NoError(errs.err())
+	var section ConfigErrors
+	section.add("tls", errors.New("Invalid client auth mode"))
+	section.add("auth[1]", ConfigErrors{&fieldError{"endpoints", errors.New("Missing")}})
+	errs.add("server", section)
+	assert.EqualError(errs.err(), `2 problems found:
+  server.tls: Invalid client auth mode
+  server.auth[1].endpoints: Missing`)
+}
+
+func TestSectionErrors(t *testing.T) {
+	assert := assert.New(t)
+	location := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(location, []byte(`
+url: http://localhost:8080/_status/vars
+targets:
+  - url: http://node2:8080/_status/vars
+port: 8080
+bucket:
+  startns: 1000
+  bins: 10
+upstream:
+  timeout: -1s
+  maxretries: -2
+session:
+  usernamefile: /run/secrets/username
+discovery:
+  source: dns
+  httpport: 70000
+otlp:
+  url: http://collector:4318/v1/metrics
+  scale: 30
+  maxretries: -2
+graphite:
+  address: graphite
+  quantiles: [0.5, 2]
+influx:
+  url: http://influx:8086/api/v2/write
+  username: crdb
+  bearertoken: secret
+`), 0600))
+	_, err := LoadConfig(location)
+	assert.EqualError(err, location+`: 11 problems found:
+  upstream.timeout: Invalid upstream duration -1s
+  upstream.maxretries: Invalid upstream max retries
+  session.passwordfile: The session password file or environment variable is required
+  targets: The targets cannot be listed when the nodes are discovered
+  discovery.source: Invalid discovery source: dns
+  discovery.httpport: Invalid discovery http port
+  otlp.scale: Invalid OTLP exponential histogram scale
+  otlp.maxretries: Invalid max retries
+  graphite.address: address graphite: missing port in address
+  graphite.quantiles[1]: Invalid graphite quantile 2
+  influx.bearertoken: Only one of basic auth or bearer token can be configured`)
+}
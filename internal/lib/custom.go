@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/groupcache/lru"
@@ -23,7 +24,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const defaultLimit = 50
+const (
+	defaultLimit     = 50
+	defaultFrequency = 10 * time.Second
+)
 
 const isNodeQuery = `
 SELECT
@@ -127,6 +131,8 @@ var (
 // Collector queries the database to collect custom metrics
 type Collector struct {
 	first         bool
+	status        *Status
+	mu            sync.Mutex
 	config        Custom
 	pool          *pgxpool.Pool
 	logicalIOLast logicalIO
@@ -157,35 +163,52 @@ type logicalIO struct {
 	healthy   int
 }
 
+// poolConfig returns the connection configuration, with the password read from the
+// file or the environment variable, if set. The password is read at every connection
+// attempt, so that a rotated secret is picked up.
+func (c Custom) poolConfig() (*pgxpool.Config, error) {
+	poolConfig, err := pgxpool.ParseConfig(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	if c.PasswordFile != "" || c.PasswordEnv != "" {
+		password, err := readCredential("", c.PasswordFile, c.PasswordEnv)
+		if err != nil {
+			return nil, err
+		}
+		poolConfig.ConnConfig.Password = password
+	}
+	return poolConfig, nil
+}
+
 // NewCollector creates a new collector for retrieving sql activity from the
-// internal CRDB tables
-func NewCollector(ctx context.Context, config Custom) (*Collector, error) {
+// internal CRDB tables. The optional status tracks the connectivity to the database.
+func NewCollector(ctx context.Context, config Custom, status *Status) (*Collector, error) {
 
 	var pool *pgxpool.Pool
 	sleep := 5
 	for {
-		poolConfig, err := pgxpool.ParseConfig(config.URL)
-		if err != nil {
-			log.Error(err)
-			log.Warnf("Unable to connect to the db. Retrying in %d seconds", sleep)
-			time.Sleep(time.Duration(sleep * int(time.Second)))
-		} else {
+		poolConfig, err := config.poolConfig()
+		if err == nil {
 			pool, err = pgxpool.ConnectConfig(ctx, poolConfig)
-			if err != nil {
-				log.Error(err)
-				log.Warnf("Unable to connect to the db. Retrying in %d seconds", sleep)
-				time.Sleep(time.Duration(sleep * int(time.Second)))
-			} else {
+			if err == nil {
 				break
 			}
 		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Error(err)
+		status.Set(err)
+		log.Warnf("Unable to connect to the db. Retrying in %d seconds", sleep)
+		if !Sleep(ctx, time.Duration(sleep*int(time.Second))) {
+			return nil, ctx.Err()
+		}
 		if sleep < 60 {
 			sleep += 5
 		}
 	}
-	if config.Limit == 0 {
-		config.Limit = defaultLimit
-	}
+	config = config.withDefaults()
 	countCache := lru.New(config.Limit * 2)
 	countCache.OnEvicted = func(key lru.Key, value interface{}) {
 		switch k := key.(type) {
@@ -196,14 +219,66 @@ func NewCollector(ctx context.Context, config Custom) (*Collector, error) {
 			}
 		}
 	}
+	status.Set(nil)
 	return &Collector{
 		first:        true,
+		status:       status,
 		config:       config,
 		pool:         pool,
 		metricsCache: countCache,
 	}, nil
 }
 
+// withDefaults returns the configuration, with the defaults for the unset settings.
+func (c Custom) withDefaults() Custom {
+	if c.Limit == 0 {
+		c.Limit = defaultLimit
+	}
+	return c
+}
+
+// frequency returns how often the custom metrics are retrieved.
+func (c Custom) frequency() time.Duration {
+	if c.Frequency == 0 {
+		return defaultFrequency
+	}
+	return time.Duration(c.Frequency) * time.Second
+}
+
+// SetConfig replaces the settings of the collector, e.g. when the configuration
+// is reloaded. The connection to the database is not changed.
+func (c *Collector) SetConfig(config Custom) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config.withDefaults()
+}
+
+func (c *Collector) getConfig() Custom {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+// Run retrieves the custom metrics with the configured frequency, until the context is done.
+func (c *Collector) Run(ctx context.Context) {
+	for {
+		if err := c.GetCustomMetrics(ctx); ctx.Err() == nil {
+			c.status.Set(err)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		if !Sleep(ctx, c.getConfig().frequency()) {
+			return
+		}
+	}
+}
+
+// Close closes the connection pool.
+func (c *Collector) Close() {
+	c.pool.Close()
+}
+
 // GetCustomMetrics retrieves all the custom metrics
 func (c *Collector) GetCustomMetrics(ctx context.Context) error {
 	var err error
@@ -225,7 +300,7 @@ func (c *Collector) GetCustomMetrics(ctx context.Context) error {
 
 // GetStatement retrieves the statement associated to the given in
 func (c *Collector) GetStatement(ctx context.Context, id string) (string, error) {
-	if c.config.DisableGetStatement {
+	if c.getConfig().DisableGetStatement {
 		return "", nil
 	}
 	s, err := strconv.ParseUint(id, 10, 64)
@@ -269,21 +344,24 @@ func (c *Collector) IsMainNode(ctx context.Context) (bool, error) {
 	return res, nil
 }
 
-func (c *Collector) getActivity(ctx context.Context) error {
-	if c.config.SkipActivity {
+func (c *Collector) getActivity(ctx context.Context) (err error) {
+	config := c.getConfig()
+	if config.SkipActivity {
 		return nil
 	}
+	defer func(start time.Time) { observeQuery("activity", start, err) }(time.Now())
 	tx, err := c.getConnection(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Release()
-	rows, err := tx.Query(ctx, stmtActivity, c.config.Limit)
+	rows, err := tx.Query(ctx, stmtActivity, config.Limit)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 	resetGauges()
+	c.metricsCache.MaxEntries = config.Limit * 2
 	for rows.Next() {
 		r := &activity{}
 		err := rows.Scan(&r.time, &r.id, &r.app, &r.database, &r.cnt, &r.maxDiskUsage,
@@ -342,10 +420,11 @@ func (c *Collector) getConnection(ctx context.Context) (*pgxpool.Conn, error) {
 	return c.pool.Acquire(ctx)
 }
 
-func (c *Collector) getEfficiency(ctx context.Context) error {
-	if c.config.SkipEfficiency {
+func (c *Collector) getEfficiency(ctx context.Context) (err error) {
+	if c.getConfig().SkipEfficiency {
 		return nil
 	}
+	defer func(start time.Time) { observeQuery("efficiency", start, err) }(time.Now())
 	tx, err := c.getConnection(ctx)
 	if err != nil {
 		log.Tracef("getEfficiency getConnection %s", err.Error())
@@ -0,0 +1,242 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Discovery sources.
+const (
+	HTTPDiscovery = "http"
+	SQLDiscovery  = "sql"
+)
+
+const (
+	defaultDiscoveryInterval = time.Minute
+	defaultDiscoveryHTTPPort = 8080
+	defaultMetricsPath       = "/_status/vars"
+	nodesPath                = "/_status/nodes"
+	nodeLabel                = "node"
+)
+
+// Node liveness status, as reported by /_status/nodes.
+const (
+	nodeStatusLive     = 3
+	nodeStatusDraining = 6
+)
+
+var nodeStatusNames = map[string]int{
+	"NODE_STATUS_LIVE":     nodeStatusLive,
+	"NODE_STATUS_DRAINING": nodeStatusDraining,
+}
+
+const gossipNodesQuery = `
+SELECT
+  n.node_id, n.address
+FROM
+  crdb_internal.gossip_nodes AS n
+  JOIN crdb_internal.gossip_liveness AS l ON n.node_id = l.node_id
+WHERE
+  n.is_live AND NOT l.decommissioning
+ORDER BY
+  n.node_id;`
+
+// Node is a live node in the cluster.
+// Address is the host:port of the HTTP endpoint, if known, or of the RPC endpoint.
+type Node struct {
+	ID      int
+	Address string
+}
+
+// NodeLister lists the live nodes in the cluster.
+type NodeLister interface {
+	ListNodes(ctx context.Context) ([]Node, error)
+}
+
+// Discoverer periodically lists the live nodes in the cluster, and
+// updates the targets of the MetricsReader.
+type Discoverer struct {
+	config Discovery
+	reader *MetricsReader
+	lister NodeLister
+}
+
+type nodesResponse struct {
+	Nodes []struct {
+		Desc struct {
+			NodeID      int `json:"nodeId"`
+			HTTPAddress struct {
+				AddressField string `json:"addressField"`
+			} `json:"httpAddress"`
+		} `json:"desc"`
+	} `json:"nodes"`
+	LivenessByNodeID map[string]json.RawMessage `json:"livenessByNodeId"`
+}
+
+// NewDiscoverer instantiates a Discoverer
+func NewDiscoverer(config *Config, reader *MetricsReader, lister NodeLister) *Discoverer {
+	d := config.Discovery
+	if d.Interval <= 0 {
+		d.Interval = defaultDiscoveryInterval
+	}
+	if d.HTTPPort == 0 {
+		d.HTTPPort = defaultDiscoveryHTTPPort
+	}
+	if d.Scheme == "" {
+		d.Scheme = "http"
+		if u, err := url.Parse(config.URL); err == nil && u.Scheme != "" {
+			d.Scheme = u.Scheme
+		} else if config.UpstreamTLS() != (TLSConfig{}) {
+			d.Scheme = "https"
+		}
+	}
+	if d.Path == "" {
+		d.Path = defaultMetricsPath
+	}
+	return &Discoverer{
+		config: d,
+		reader: reader,
+		lister: lister,
+	}
+}
+
+// Run refreshes the targets until the context is done.
+func (d *Discoverer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Discover(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Error discovering nodes: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover lists the nodes and updates the targets. If the nodes cannot be
+// listed, the current targets are preserved.
+func (d *Discoverer) Discover(ctx context.Context) error {
+	nodes, err := d.lister.ListNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("No live nodes found")
+	}
+	targets := make([]Target, 0, len(nodes))
+	for _, n := range nodes {
+		address := n.Address
+		if d.config.Source == SQLDiscovery {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			address = net.JoinHostPort(host, strconv.Itoa(d.config.HTTPPort))
+		}
+		u := url.URL{Scheme: d.config.Scheme, Host: address, Path: d.config.Path}
+		targets = append(targets, Target{
+			URL:    u.String(),
+			Labels: map[string]string{nodeLabel: strconv.Itoa(n.ID)},
+		})
+	}
+	log.Debugf("Discovered %d nodes", len(targets))
+	d.reader.SetTargets(targets)
+	return nil
+}
+
+// ListNodes returns the live nodes, using the /_status/nodes API of the node at the url.
+func (r *MetricsReader) ListNodes(ctx context.Context) ([]Node, error) {
+	u, err := url.Parse(r.Config.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = nodesPath
+	u.RawQuery = ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := http.Client{Transport: r.roundTripper(r.Transport)}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	var nodes nodesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	var res []Node
+	for _, n := range nodes.Nodes {
+		id := n.Desc.NodeID
+		if len(nodes.LivenessByNodeID) > 0 {
+			status, ok := nodes.LivenessByNodeID[strconv.Itoa(id)]
+			if !ok || !isLive(status) {
+				log.Debugf("Skipping node %d, not live", id)
+				continue
+			}
+		}
+		res = append(res, Node{ID: id, Address: n.Desc.HTTPAddress.AddressField})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res, nil
+}
+
+// isLive returns true if the node is live or draining. The status
+// can be encoded either as a number or as the enum name.
+func isLive(status json.RawMessage) bool {
+	var value int
+	if err := json.Unmarshal(status, &value); err != nil {
+		var name string
+		if err := json.Unmarshal(status, &name); err != nil {
+			return false
+		}
+		value = nodeStatusNames[name]
+	}
+	return value == nodeStatusLive || value == nodeStatusDraining
+}
+
+// ListNodes returns the live nodes that are not decommissioning, querying
+// crdb_internal.gossip_nodes. The address is the RPC address of the node.
+func (c *Collector) ListNodes(ctx context.Context) ([]Node, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(ctx, gossipNodesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []Node
+	for rows.Next() {
+		var n Node
+		if err := rows.Scan(&n.ID, &n.Address); err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	node2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns 2\n"))
+	}))
+	defer node2.Close()
+	node2URL, err := url.Parse(node2.URL)
+	require.NoError(t, err)
+
+	var node1Host string
+	decommissioned := false
+	node1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_status/nodes":
+			status := `"NODE_STATUS_LIVE"`
+			if decommissioned {
+				status = "5"
+			}
+			fmt.Fprintf(w, `{"nodes": [
+				{"desc": {"nodeId": 1, "httpAddress": {"addressField": "%s"}}},
+				{"desc": {"nodeId": 2, "httpAddress": {"addressField": "%s"}}},
+				{"desc": {"nodeId": 3, "httpAddress": {"addressField": "localhost:1"}}}
+			],
+			"livenessByNodeId": {"1": 3, "2": %s, "3": "NODE_STATUS_DEAD"}}`,
+				node1Host, node2URL.Host, status)
+		case "/_status/vars":
+			_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns 1\n"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer node1.Close()
+	node1URL, err := url.Parse(node1.URL)
+	require.NoError(t, err)
+	node1Host = node1URL.Host
+
+	config := &Config{
+		URL:       node1.URL + "/_status/vars",
+		Discovery: Discovery{Source: HTTPDiscovery},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	discoverer := NewDiscoverer(config, reader, reader)
+	require.NoError(t, discoverer.Discover(context.Background()))
+
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	conns := mfs["sql_conns"].Metric
+	require.Len(t, conns, 2)
+	assert.Equal([]string{"instance", "node"},
+		[]string{conns[0].Label[0].GetName(), conns[0].Label[1].GetName()})
+	assert.Equal("1", conns[0].Label[1].GetValue())
+	assert.Equal(1.0, conns[0].GetGauge().GetValue())
+	assert.Equal("2", conns[1].Label[1].GetValue())
+	assert.Equal(2.0, conns[1].GetGauge().GetValue())
+
+	decommissioned = true
+	require.NoError(t, discoverer.Discover(context.Background()))
+	mfs, err = reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Len(mfs["sql_conns"].Metric, 1)
+	assert.Len(mfs[targetUpName].Metric, 1)
+}
@@ -0,0 +1,265 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Graphite protocols and histogram modes.
+const (
+	GraphiteProtocol  = "graphite"
+	StatsDProtocol    = "statsd"
+	GraphiteBuckets   = "buckets"
+	GraphiteQuantiles = "quantiles"
+)
+
+// maxStatsDPacket is the max payload size of a StatsD packet, to avoid IP fragmentation.
+const maxStatsDPacket = 1432
+
+var defaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// GraphiteSink periodically collects the metrics, including the custom metrics,
+// flattens them into paths and pushes them to Graphite or StatsD.
+type GraphiteSink struct {
+	config   Graphite
+	pipeline *Pipeline
+}
+
+type graphiteSample struct {
+	path  string
+	value float64
+}
+
+// NewGraphiteSink instantiates a GraphiteSink
+func NewGraphiteSink(config Graphite, pipeline *Pipeline) *GraphiteSink {
+	if config.Protocol == "" {
+		config.Protocol = GraphiteProtocol
+	}
+	if config.Histograms == "" {
+		config.Histograms = GraphiteBuckets
+	}
+	if len(config.Quantiles) == 0 {
+		config.Quantiles = defaultQuantiles
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultPushInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultPushTimeout
+	}
+	return &GraphiteSink{
+		config:   config,
+		pipeline: pipeline,
+	}
+}
+
+// Run collects and pushes the metrics until the context is done.
+func (g *GraphiteSink) Run(ctx context.Context) {
+	runPushLoop(ctx, g.config.Protocol, g.config.Interval, nil, g.collect)
+}
+
+func (g *GraphiteSink) collect(ctx context.Context) error {
+	metricFamilies, err := g.pipeline.GatherAll(ctx)
+	if err != nil {
+		return err
+	}
+	samples := g.flatten(metricFamilies)
+	log.Tracef("%s: %d samples", g.config.Protocol, len(samples))
+	if g.config.Protocol == StatsDProtocol {
+		return g.sendStatsD(ctx, samples)
+	}
+	return g.sendGraphite(ctx, samples, time.Now())
+}
+
+// flatten converts the metric families into Graphite paths.
+func (g *GraphiteSink) flatten(metricFamilies map[string]*dto.MetricFamily) []graphiteSample {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var res []graphiteSample
+	for _, name := range names {
+		mf := metricFamilies[name]
+		for _, m := range mf.Metric {
+			base := g.path(mf.GetName(), m.Label)
+			add := func(value float64, suffix ...string) {
+				if math.IsNaN(value) {
+					return
+				}
+				path := base
+				if len(suffix) > 0 {
+					path = path + "." + strings.Join(suffix, ".")
+				}
+				res = append(res, graphiteSample{path: path, value: value})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add(q.GetValue(), quantileName(q.GetQuantile()))
+				}
+				add(m.GetSummary().GetSampleSum(), "sum")
+				add(float64(m.GetSummary().GetSampleCount()), "count")
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				if g.config.Histograms == GraphiteQuantiles {
+					for _, q := range g.config.Quantiles {
+						add(bucketQuantile(q, h), quantileName(q))
+					}
+				} else {
+					for _, b := range h.GetBucket() {
+						if math.IsInf(b.GetUpperBound(), 1) {
+							continue
+						}
+						le := strconv.FormatFloat(b.GetUpperBound(), 'f', -1, 64)
+						add(float64(b.GetCumulativeCount()), "bucket", "le_"+sanitizePath(le))
+					}
+					add(float64(h.GetSampleCount()), "bucket", "le_inf")
+				}
+				add(h.GetSampleSum(), "sum")
+				add(float64(h.GetSampleCount()), "count")
+			}
+		}
+	}
+	return res
+}
+
+// path builds the Graphite path for a metric, based on the label mapping.
+func (g *GraphiteSink) path(name string, labels []*dto.LabelPair) string {
+	var parts []string
+	if g.config.Prefix != "" {
+		parts = append(parts, g.config.Prefix)
+	}
+	parts = append(parts, sanitizePath(name))
+	if len(g.config.Labels) > 0 {
+		for _, l := range g.config.Labels {
+			for _, lp := range labels {
+				if lp.GetName() == l && lp.GetValue() != "" {
+					parts = append(parts, sanitizePath(lp.GetValue()))
+				}
+			}
+		}
+	} else {
+		sorted := make([]*dto.LabelPair, len(labels))
+		copy(sorted, labels)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].GetName() < sorted[j].GetName() })
+		for _, lp := range sorted {
+			parts = append(parts, sanitizePath(lp.GetName()), sanitizePath(lp.GetValue()))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// sendGraphite sends the samples using the plaintext protocol.
+func (g *GraphiteSink) sendGraphite(
+	ctx context.Context, samples []graphiteSample, now time.Time,
+) error {
+	var buf bytes.Buffer
+	for _, s := range samples {
+		fmt.Fprintf(&buf, "%s %s %d\n", s.path, formatFloat(s.value), now.Unix())
+	}
+	dialer := net.Dialer{Timeout: g.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", g.config.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(g.config.Timeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// sendStatsD sends the samples as gauges, batching them in packets.
+func (g *GraphiteSink) sendStatsD(ctx context.Context, samples []graphiteSample) error {
+	dialer := net.Dialer{Timeout: g.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "udp", g.config.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var buf bytes.Buffer
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(buf.Bytes())
+		buf.Reset()
+		return err
+	}
+	for _, s := range samples {
+		line := fmt.Sprintf("%s:%s|g\n", s.path, formatFloat(s.value))
+		if buf.Len()+len(line) > maxStatsDPacket {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(line)
+	}
+	return flush()
+}
+
+// bucketQuantile estimates the quantile from the cumulative buckets,
+// assuming a linear distribution within each bucket.
+func bucketQuantile(q float64, h *dto.Histogram) float64 {
+	buckets := h.GetBucket()
+	if h.GetSampleCount() == 0 || len(buckets) == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(h.GetSampleCount())
+	lower, prevCount := 0.0, 0.0
+	for _, b := range buckets {
+		count := float64(b.GetCumulativeCount())
+		if count >= rank {
+			if math.IsInf(b.GetUpperBound(), 1) || count == prevCount {
+				return lower
+			}
+			return lower + (b.GetUpperBound()-lower)*(rank-prevCount)/(count-prevCount)
+		}
+		lower, prevCount = b.GetUpperBound(), count
+	}
+	// The rank falls in the implicit +Inf bucket.
+	return lower
+}
+
+// quantileName converts a quantile into a path element, e.g. 0.99 into p99.
+func quantileName(q float64) string {
+	// Rounding to avoid floating point artifacts, e.g. 0.29*100 = 28.999999999999996
+	p := math.Round(q*100*1e6) / 1e6
+	return "p" + sanitizePath(strconv.FormatFloat(p, 'f', -1, 64))
+}
+
+// sanitizePath replaces the characters that are not allowed in a Graphite path element.
+func sanitizePath(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
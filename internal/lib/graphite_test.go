@@ -0,0 +1,90 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGraphite(t *testing.T) {
+	assert := assert.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var lines []string
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		received <- lines
+	}()
+
+	sink := NewGraphiteSink(Graphite{
+		Address:  listener.Addr().String(),
+		Interval: time.Hour,
+		Prefix:   "crdb",
+		Labels:   []string{"store"},
+	}, newTestPipeline(t, input))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.Run(ctx)
+
+	var lines []string
+	select {
+	case lines = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for graphite")
+	}
+	// 34 buckets, including +Inf, plus sum and count.
+	require.Len(t, lines, 36)
+	fields := strings.Fields(lines[0])
+	require.Len(t, fields, 3)
+	assert.Equal("crdb.raft_process_logcommit_latency.1.bucket.le_70000", fields[0])
+	assert.Equal("8", fields[1])
+	assert.True(strings.HasPrefix(lines[33], "crdb.raft_process_logcommit_latency.1.bucket.le_inf "))
+	assert.True(strings.HasPrefix(lines[35], "crdb.raft_process_logcommit_latency.1.count 9.4176681e+07 "))
+}
+
+func TestStatsDQuantiles(t *testing.T) {
+	assert := assert.New(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sink := NewGraphiteSink(Graphite{
+		Address:    conn.LocalAddr().String(),
+		Protocol:   StatsDProtocol,
+		Histograms: GraphiteQuantiles,
+		Quantiles:  []float64{0.5, 0.999},
+	}, newTestPipeline(t, input))
+	require.NoError(t, sink.collect(context.Background()))
+
+	buf := make([]byte, maxStatsDPacket)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(buf[:n])), "\n")
+	require.Len(t, lines, 4)
+	assert.True(strings.HasPrefix(lines[0], "raft_process_logcommit_latency.store.1.p50:"))
+	assert.True(strings.HasPrefix(lines[1], "raft_process_logcommit_latency.store.1.p99_9:"))
+	assert.Equal("raft_process_logcommit_latency.store.1.count:9.4176681e+07|g", lines[3])
+}
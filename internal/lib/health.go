@@ -0,0 +1,211 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Health endpoints.
+const (
+	LivenessEndpoint  = "/healthz"
+	ReadinessEndpoint = "/readyz"
+)
+
+// Component statuses.
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing"
+	StatusUnknown = "unknown"
+)
+
+const (
+	// probeInterval is how long a failing component must wait before it is probed again.
+	probeInterval = 10 * time.Second
+	// probeTimeout is the max time the readiness endpoint waits for the probes.
+	probeTimeout = 5 * time.Second
+)
+
+// Status tracks the health of a component of the exporter (e.g. the upstream scrapes).
+// A nil Status ignores the updates.
+type Status struct {
+	mu        sync.Mutex
+	checked   bool
+	err       error
+	lastCheck time.Time
+	probe     func(ctx context.Context)
+}
+
+// Set records the outcome of the last check of the component.
+func (s *Status) Set(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checked, s.err, s.lastCheck = true, err, time.Now()
+}
+
+// SetProbe sets the function that checks the component again. The readiness endpoint
+// calls it when the component has been failing for more than probeInterval, so that
+// it recovers even if nothing else checks it (e.g. no scrapes reach an unready exporter).
+// The probe updates the status itself.
+func (s *Status) SetProbe(probe func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probe = probe
+}
+
+// probeIfStale returns the probe, if the component has been failing for more than probeInterval.
+func (s *Status) probeIfStale() func(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.probe == nil || s.err == nil || time.Since(s.lastCheck) < probeInterval {
+		return nil
+	}
+	return s.probe
+}
+
+// ComponentReport is the health of a component, as reported by the readiness endpoint.
+type ComponentReport struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	LastCheck *time.Time `json:"lastCheck,omitempty"`
+}
+
+// HealthReport is the response of the health endpoints.
+type HealthReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentReport `json:"components,omitempty"`
+}
+
+func (s *Status) report() ComponentReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checked {
+		return ComponentReport{Status: StatusUnknown}
+	}
+	lastCheck := s.lastCheck
+	if s.err != nil {
+		// The database errors may include the connection string.
+		return ComponentReport{Status: StatusFailing, Error: Redact(s.err.Error()), LastCheck: &lastCheck}
+	}
+	return ComponentReport{Status: StatusOK, LastCheck: &lastCheck}
+}
+
+// Health reports the liveness of the exporter, and its readiness based on the
+// status of its components. The exporter is ready if none of the components is failing;
+// the components that have not been checked yet do not affect the readiness.
+type Health struct {
+	mu         sync.Mutex
+	components map[string]*Status
+}
+
+// NewHealth instantiates a Health.
+func NewHealth() *Health {
+	return &Health{components: make(map[string]*Status)}
+}
+
+// Component returns the Status of the named component, registering it if needed.
+func (h *Health) Component(name string) *Status {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.components[name]
+	if !ok {
+		s = &Status{}
+		h.components[name] = s
+	}
+	return s
+}
+
+// Report returns the status of the components, and whether the exporter is ready.
+func (h *Health) Report() (HealthReport, bool) {
+	h.mu.Lock()
+	names := make([]string, 0, len(h.components))
+	for name := range h.components {
+		names = append(names, name)
+	}
+	h.mu.Unlock()
+	sort.Strings(names)
+	res := HealthReport{
+		Status:     StatusOK,
+		Components: make(map[string]ComponentReport, len(names)),
+	}
+	for _, name := range names {
+		s := h.Component(name)
+		report := s.report()
+		if report.Status == StatusFailing {
+			res.Status = StatusFailing
+		}
+		res.Components[name] = report
+	}
+	return res, res.Status != StatusFailing
+}
+
+// LivenessHandler responds with 200 OK as long as the process is serving requests.
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, HealthReport{Status: StatusOK})
+	})
+}
+
+// probe runs the probes of the components that have been failing for more than probeInterval.
+func (h *Health) probe(ctx context.Context) {
+	h.mu.Lock()
+	var probes []func(ctx context.Context)
+	for _, s := range h.components {
+		if probe := s.probeIfStale(); probe != nil {
+			probes = append(probes, probe)
+		}
+	}
+	h.mu.Unlock()
+	if len(probes) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, probe := range probes {
+		wg.Add(1)
+		go func(probe func(ctx context.Context)) {
+			defer wg.Done()
+			probe(ctx)
+		}(probe)
+	}
+	wg.Wait()
+}
+
+// ReadinessHandler responds with 200 OK if the exporter is ready, and with
+// 503 Service Unavailable otherwise, reporting the status of each component.
+// The failing components with a probe are checked again, if their status is stale.
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.probe(r.Context())
+		report, ready := h.Report()
+		code := http.StatusOK
+		if !ready {
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, report)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, code int, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getHealth(t *testing.T, handler http.Handler) (int, HealthReport) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, ReadinessEndpoint, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var report HealthReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, report
+}
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+	health := NewHealth()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer upstream.Close()
+	config := &Config{URL: upstream.URL, Upstream: Upstream{MaxRetries: -1}}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	pipeline := CreatePipeline(reader, CreateMetricsWriter(config))
+	pipeline.Status = health.Component("upstream")
+	health.Component("sql").Set(nil)
+
+	// The components not checked yet do not affect the readiness.
+	code, report := getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(StatusOK, report.Status)
+	assert.Equal(StatusUnknown, report.Components["upstream"].Status)
+	assert.Equal(StatusOK, report.Components["sql"].Status)
+	assert.NotNil(report.Components["sql"].LastCheck)
+
+	_, err = pipeline.Gather(context.Background())
+	assert.Error(err)
+	code, report = getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(StatusFailing, report.Status)
+	assert.Equal(StatusFailing, report.Components["upstream"].Status)
+	assert.Equal(err.Error(), report.Components["upstream"].Error)
+
+	// The liveness does not depend on the components.
+	code, report = getHealth(t, health.LivenessHandler())
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(StatusOK, report.Status)
+	assert.Empty(report.Components)
+
+	// A nil status ignores the updates.
+	var status *Status
+	status.Set(nil)
+}
+
+func TestHealthRecovery(t *testing.T) {
+	assert := assert.New(t)
+	health := NewHealth()
+
+	// A rejected reload makes the exporter unready, until the next successful reload.
+	config := health.Component("config")
+	config.Set(errors.New("invalid configuration"))
+	code, report := getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(StatusFailing, report.Components["config"].Status)
+	config.Set(nil)
+	code, _ = getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusOK, code)
+
+	// A failing component is probed again, once its status is stale.
+	upstream := health.Component("upstream")
+	probes := 0
+	upstream.SetProbe(func(ctx context.Context) {
+		probes++
+		upstream.Set(nil)
+	})
+	upstream.Set(errors.New("connection refused"))
+	code, _ = getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusServiceUnavailable, code)
+	assert.Equal(0, probes)
+	upstream.mu.Lock()
+	upstream.lastCheck = upstream.lastCheck.Add(-probeInterval)
+	upstream.mu.Unlock()
+	code, _ = getHealth(t, health.ReadinessHandler())
+	assert.Equal(http.StatusOK, code)
+	assert.Equal(1, probes)
+}
+
+func TestHealthCallerCancellation(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	pipeline, _ := newCountingPipeline(t, 0, release)
+	status := &Status{}
+	pipeline.Status = status
+
+	// The scrape that gives up does not mark the upstream as failing.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := pipeline.Gather(ctx)
+	assert.Error(err)
+	// The read is bounded by the deadline of the scrape that started it.
+	assert.Eventually(func() bool {
+		pipeline.mu.Lock()
+		defer pipeline.mu.Unlock()
+		return pipeline.flight == nil
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(StatusUnknown, status.report().Status)
+	close(release)
+	_, err = pipeline.Gather(context.Background())
+	require.NoError(t, err)
+	assert.Equal(StatusOK, status.report().Status)
+}
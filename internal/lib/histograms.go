@@ -125,3 +125,16 @@ func TranslateHistogram(config *BucketConfig, mf *dto.MetricFamily) {
 		m.Histogram.Bucket = newBuckets
 	}
 }
+
+// BucketBounds returns the upper bounds, in the configured unit, of the log10 linear buckets
+// from the configured lower range up to max (in nanoseconds). The translated histograms
+// have these buckets, except the ones below the lowest bucket of each HDR histogram.
+func BucketBounds(config *BucketConfig, max float64) []float64 {
+	b := createLog10Bucket(float64(config.Startns), max, config.Bins, config.UnitDiv())
+	var res []float64
+	for b.binUpperBound() < b.Max {
+		res = append(res, b.binUpperBound()/b.UnitDiv)
+		b.nextBin()
+	}
+	return append(res, b.binUpperBound()/b.UnitDiv)
+}
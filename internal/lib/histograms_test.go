@@ -78,3 +78,13 @@ func TestIdentityConversion(t *testing.T) {
 	}
 
 }
+
+func TestBucketBounds(t *testing.T) {
+	assert := assert.New(t)
+	config := &BucketConfig{
+		Startns: 1000,
+		Bins:    5,
+		Unit:    "microseconds"}
+	assert.Equal([]float64{1, 2, 4, 6, 8, 10, 20, 40, 60, 80, 100},
+		BucketBounds(config, 100000))
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// InfluxContentType is the media type used for the InfluxDB line protocol.
+const InfluxContentType = "application/x-influx-line-protocol"
+
+// InfluxFormat is the value of the format query parameter to request the line protocol.
+const InfluxFormat = "influx"
+
+var influxHeaders = map[string]string{
+	"Content-Type": "text/plain; charset=utf-8",
+	"User-Agent":   "metrics-exporter",
+}
+
+// The backslashes in the tags are escaped (in the same pass as the separators), so that
+// a value ending with one is not read as an escaped separator.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(`\`, `\\`, ",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// InfluxSink periodically collects the metrics, including the custom metrics,
+// and pushes them to an InfluxDB compatible write API.
+type InfluxSink struct {
+	interval time.Duration
+	pipeline *Pipeline
+	queue    *pushQueue
+}
+
+// NewInfluxSink instantiates an InfluxSink
+func NewInfluxSink(config Influx, pipeline *Pipeline) *InfluxSink {
+	if config.Interval <= 0 {
+		config.Interval = defaultPushInterval
+	}
+	if config.TokenScheme == "" {
+		config.TokenScheme = "Token"
+	}
+	return &InfluxSink{
+		interval: config.Interval,
+		pipeline: pipeline,
+		queue:    newPushQueue(config.PushEndpoint, influxHeaders),
+	}
+}
+
+// Run collects and pushes the metrics until the context is done.
+func (s *InfluxSink) Run(ctx context.Context) {
+	runPushLoop(ctx, "InfluxDB", s.interval, []*pushQueue{s.queue}, s.collect)
+}
+
+func (s *InfluxSink) collect(ctx context.Context) error {
+	metricFamilies, err := s.pipeline.GatherAll(ctx)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := WriteInflux(&buf, metricFamilies, time.Now()); err != nil {
+		return err
+	}
+	log.Tracef("InfluxDB: %d bytes", buf.Len())
+	s.queue.enqueue(buf.Bytes())
+	return nil
+}
+
+// WantsInflux returns true if the request asks for the InfluxDB line protocol,
+// either with the format query parameter or with the Accept header.
+func WantsInflux(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == InfluxFormat
+	}
+	return strings.Contains(r.Header.Get("Accept"), InfluxContentType)
+}
+
+// WriteInflux writes the metric families using the InfluxDB line protocol.
+// Each metric family is a measurement, and the labels are the tags.
+// Counters, gauges and untyped metrics have a single value field;
+// histograms have a field for each bucket (le_<upper bound>), plus sum and count;
+// summaries have a field for each quantile (quantile_<quantile>), plus sum and count.
+func WriteInflux(out io.Writer, metricFamilies map[string]*dto.MetricFamily, now time.Time) error {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := bufio.NewWriter(out)
+	for _, name := range names {
+		mf := metricFamilies[name]
+		measurement := measurementEscaper.Replace(mf.GetName())
+		for _, m := range mf.Metric {
+			fields := influxFields(mf.GetType(), m)
+			if len(fields) == 0 {
+				continue
+			}
+			ts := now.UnixNano()
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs() * int64(time.Millisecond)
+			}
+			w.WriteString(measurement)
+			labels := make([]*dto.LabelPair, 0, len(m.Label))
+			for _, l := range m.Label {
+				// Empty tag values are not allowed.
+				if l.GetValue() != "" {
+					labels = append(labels, l)
+				}
+			}
+			sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+			for _, l := range labels {
+				w.WriteByte(',')
+				w.WriteString(tagEscaper.Replace(l.GetName()))
+				w.WriteByte('=')
+				w.WriteString(tagEscaper.Replace(l.GetValue()))
+			}
+			for i, f := range fields {
+				if i == 0 {
+					w.WriteByte(' ')
+				} else {
+					w.WriteByte(',')
+				}
+				w.WriteString(tagEscaper.Replace(f.name))
+				w.WriteByte('=')
+				w.WriteString(strconv.FormatFloat(f.value, 'g', -1, 64))
+			}
+			w.WriteByte(' ')
+			w.WriteString(strconv.FormatInt(ts, 10))
+			w.WriteByte('\n')
+		}
+	}
+	return w.Flush()
+}
+
+type influxField struct {
+	name  string
+	value float64
+}
+
+// influxFields returns the fields for the metric. NaN and Inf values are
+// not supported by the line protocol, and they are skipped.
+func influxFields(t dto.MetricType, m *dto.Metric) []influxField {
+	var fields []influxField
+	add := func(name string, value float64) {
+		if !math.IsNaN(value) && !math.IsInf(value, 0) {
+			fields = append(fields, influxField{name, value})
+		}
+	}
+	switch t {
+	case dto.MetricType_COUNTER:
+		add("value", m.GetCounter().GetValue())
+	case dto.MetricType_GAUGE:
+		add("value", m.GetGauge().GetValue())
+	case dto.MetricType_UNTYPED:
+		add("value", m.GetUntyped().GetValue())
+	case dto.MetricType_SUMMARY:
+		for _, q := range m.GetSummary().GetQuantile() {
+			add("quantile_"+formatFloat(q.GetQuantile()), q.GetValue())
+		}
+		add("sum", m.GetSummary().GetSampleSum())
+		add("count", float64(m.GetSummary().GetSampleCount()))
+	case dto.MetricType_HISTOGRAM:
+		infSeen := false
+		for _, b := range m.GetHistogram().GetBucket() {
+			if math.IsInf(b.GetUpperBound(), 1) {
+				infSeen = true
+			}
+			add("le_"+formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+		}
+		if !infSeen {
+			add("le_+Inf", float64(m.GetHistogram().GetSampleCount()))
+		}
+		add("sum", m.GetHistogram().GetSampleSum())
+		add("count", float64(m.GetHistogram().GetSampleCount()))
+	}
+	return fields
+}
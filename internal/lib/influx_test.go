@@ -0,0 +1,96 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const influxInput = `# TYPE sql_conns gauge
+sql_conns{node="1",app_name="a, b"} 3
+# TYPE sql_query_count counter
+sql_query_count{node="1",empty="",dir="c:\\"} 12
+# TYPE exec_latency histogram
+exec_latency_bucket{node="1",le="10"} 1
+exec_latency_bucket{node="1",le="100"} 3
+exec_latency_bucket{node="1",le="+Inf"} 4
+exec_latency_sum{node="1"} 250
+exec_latency_count{node="1"} 4
+`
+
+func TestWriteInflux(t *testing.T) {
+	var parser expfmt.TextParser
+	metricFamilies, err := parser.TextToMetricFamilies(strings.NewReader(influxInput))
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	require.NoError(t, WriteInflux(&buf, metricFamilies, time.Unix(1, 0)))
+	assert.Equal(t, `exec_latency,node=1 le_10=1,le_100=3,le_+Inf=4,sum=250,count=4 1000000000
+sql_conns,app_name=a\,\ b,node=1 value=3 1000000000
+sql_query_count,dir=c:\\,node=1 value=12 1000000000
+`, buf.String())
+}
+
+func TestWantsInflux(t *testing.T) {
+	assert := assert.New(t)
+	r := httptest.NewRequest(http.MethodGet, "/_status/vars?format=influx", nil)
+	assert.True(WantsInflux(r))
+	r = httptest.NewRequest(http.MethodGet, "/_status/vars", nil)
+	assert.False(WantsInflux(r))
+	r.Header.Set("Accept", InfluxContentType)
+	assert.True(WantsInflux(r))
+	r = httptest.NewRequest(http.MethodGet, "/_status/vars?format=prometheus", nil)
+	r.Header.Set("Accept", InfluxContentType)
+	assert.False(WantsInflux(r))
+}
+
+func TestInfluxPush(t *testing.T) {
+	received := make(chan string, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "crdb", r.URL.Query().Get("bucket"))
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusNoContent)
+		select {
+		case received <- string(data):
+		default:
+		}
+	}))
+	defer receiver.Close()
+
+	sink := NewInfluxSink(Influx{
+		Interval: time.Hour,
+		PushEndpoint: PushEndpoint{
+			URL:         receiver.URL + "/api/v2/write?org=test&bucket=crdb",
+			Credentials: Credentials{BearerToken: "secret"},
+		},
+	}, newTestPipeline(t, input))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go sink.Run(ctx)
+
+	select {
+	case data := <-received:
+		lines := strings.Split(strings.TrimSpace(data), "\n")
+		require.Len(t, lines, 1)
+		assert.True(t, strings.HasPrefix(lines[0],
+			"raft_process_logcommit_latency,store=1 le_70000=8,le_80000=2513,"))
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for influx push")
+	}
+}
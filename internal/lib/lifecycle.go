@@ -0,0 +1,165 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultShutdownGrace = 15 * time.Second
+
+// Lifecycle supervises the background tasks of the exporter, and shuts them down.
+// On shutdown, within the grace period:
+// * the drain hooks are called (e.g. to complete the in-flight HTTP requests);
+// * the root context is canceled, and the tasks started with Go are awaited;
+// * the close hooks are called, in reverse order (e.g. to close the connection pools).
+type Lifecycle struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	grace    time.Duration
+	stopping chan struct{}
+	stopOnce sync.Once
+	tasks    sync.WaitGroup
+
+	mu     sync.Mutex
+	drains []func(ctx context.Context) error
+	closes []func()
+	closed bool
+}
+
+// NewLifecycle instantiates a Lifecycle, with the given grace period.
+func NewLifecycle(grace time.Duration) *Lifecycle {
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:      ctx,
+		cancel:   cancel,
+		grace:    grace,
+		stopping: make(chan struct{}),
+	}
+}
+
+// Context returns the root context, canceled during the shutdown.
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Stopping returns a channel that is closed when the shutdown is requested.
+func (l *Lifecycle) Stopping() <-chan struct{} {
+	return l.stopping
+}
+
+// Stop requests the shutdown.
+func (l *Lifecycle) Stop() {
+	l.stopOnce.Do(func() { close(l.stopping) })
+}
+
+// HandleSignals requests the shutdown when one of the signals is received.
+func (l *Lifecycle) HandleSignals(signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	go func() {
+		select {
+		case s := <-ch:
+			log.Infof("Received %s, shutting down", s)
+			l.Stop()
+		case <-l.ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+}
+
+// Go runs a task in the background. The task must return when the context is done.
+func (l *Lifecycle) Go(name string, task func(ctx context.Context)) {
+	l.tasks.Add(1)
+	go func() {
+		defer l.tasks.Done()
+		task(l.ctx)
+		log.Debugf("%s stopped", name)
+	}()
+}
+
+// OnDrain registers a hook called at the beginning of the shutdown,
+// before the root context is canceled.
+func (l *Lifecycle) OnDrain(hook func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drains = append(l.drains, hook)
+}
+
+// OnClose registers a hook called at the end of the shutdown. If the
+// shutdown is already completed, the hook is called immediately.
+func (l *Lifecycle) OnClose(hook func()) {
+	l.mu.Lock()
+	if !l.closed {
+		l.closes = append(l.closes, hook)
+		l.mu.Unlock()
+		return
+	}
+	l.mu.Unlock()
+	hook()
+}
+
+// Shutdown stops the exporter. It returns an error if the grace period
+// expires before the tasks are completed.
+func (l *Lifecycle) Shutdown() error {
+	l.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), l.grace)
+	defer cancel()
+	var res error
+	l.mu.Lock()
+	drains := l.drains
+	l.mu.Unlock()
+	for _, drain := range drains {
+		if err := drain(ctx); err != nil && res == nil {
+			res = err
+		}
+	}
+	l.cancel()
+	done := make(chan struct{})
+	go func() {
+		l.tasks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if res == nil {
+			res = errors.New("Grace period expired before the background tasks stopped")
+		}
+	}
+	l.mu.Lock()
+	closes := l.closes
+	l.closes, l.closed = nil, true
+	l.mu.Unlock()
+	for i := len(closes) - 1; i >= 0; i-- {
+		closes[i]()
+	}
+	return res
+}
+
+// Sleep waits for the duration, or until the context is done. It returns false
+// if the context is done.
+func Sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
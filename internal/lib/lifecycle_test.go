@@ -0,0 +1,72 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleShutdown(t *testing.T) {
+	assert := assert.New(t)
+	lc := NewLifecycle(time.Second)
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}
+	lc.OnClose(func() { record("close pool") })
+	lc.OnClose(func() { record("close collector") })
+	lc.OnDrain(func(ctx context.Context) error {
+		assert.NoError(lc.Context().Err())
+		record("drain")
+		return nil
+	})
+	lc.Go("task", func(ctx context.Context) {
+		for Sleep(ctx, time.Millisecond) {
+		}
+		record("task")
+	})
+
+	lc.Stop()
+	<-lc.Stopping()
+	assert.NoError(lc.Shutdown())
+	assert.Equal([]string{"drain", "task", "close collector", "close pool"}, events)
+	assert.Error(lc.Context().Err())
+
+	// Hooks registered after the shutdown are called immediately.
+	lc.OnClose(func() { record("late") })
+	assert.Equal("late", events[len(events)-1])
+}
+
+func TestLifecycleGrace(t *testing.T) {
+	assert := assert.New(t)
+	lc := NewLifecycle(50 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	lc.Go("stuck", func(ctx context.Context) {
+		<-release
+	})
+	closed := false
+	lc.OnClose(func() { closed = true })
+	assert.EqualError(lc.Shutdown(), "Grace period expired before the background tasks stopped")
+	assert.True(closed)
+}
+
+func TestSleep(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(Sleep(context.Background(), time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(Sleep(ctx, time.Hour))
+}
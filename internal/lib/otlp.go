@@ -0,0 +1,335 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	defaultExponentialScale = 3
+	// AGGREGATION_TEMPORALITY_CUMULATIVE
+	cumulativeTemporality = 2
+	otlpScopeName         = "github.com/cockroachlabs/metrics-exporter"
+)
+
+var otlpHeaders = map[string]string{
+	"Content-Type": "application/x-protobuf",
+	"User-Agent":   "metrics-exporter",
+}
+
+// OTLPExporter periodically collects the metrics, including the custom metrics,
+// and pushes them to an OpenTelemetry collector.
+type OTLPExporter struct {
+	config     OTLP
+	pipeline   *Pipeline
+	queue      *pushQueue
+	attributes []label
+	start      time.Time
+}
+
+// NewOTLPExporter instantiates an OTLPExporter
+func NewOTLPExporter(config *Config, pipeline *Pipeline) *OTLPExporter {
+	otlp := config.OTLP
+	if otlp.Interval <= 0 {
+		otlp.Interval = defaultPushInterval
+	}
+	if otlp.Scale == nil {
+		scale := defaultExponentialScale
+		otlp.Scale = &scale
+	}
+	node := otlp.Node
+	if node == "" {
+		if u, err := url.Parse(config.URL); err == nil {
+			node = u.Host
+		}
+	}
+	attributes := []label{{"service.name", "metrics-exporter"}}
+	if otlp.Cluster != "" {
+		attributes = append(attributes, label{"cluster", otlp.Cluster})
+	}
+	if node != "" {
+		attributes = append(attributes, label{"node", node})
+	}
+	for k, v := range otlp.Attributes {
+		attributes = append(attributes, label{k, v})
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].name < attributes[j].name })
+	return &OTLPExporter{
+		config:     otlp,
+		pipeline:   pipeline,
+		queue:      newPushQueue(otlp.PushEndpoint, otlpHeaders),
+		attributes: attributes,
+		start:      time.Now(),
+	}
+}
+
+// Run collects and pushes the metrics until the context is done.
+func (e *OTLPExporter) Run(ctx context.Context) {
+	runPushLoop(ctx, "OTLP", e.config.Interval, []*pushQueue{e.queue}, e.collect)
+}
+
+// collect gathers the metrics and adds the encoded payload to the queue.
+func (e *OTLPExporter) collect(ctx context.Context) error {
+	var metricFamilies map[string]*dto.MetricFamily
+	var err error
+	if e.config.ExponentialHistograms {
+		metricFamilies, err = e.pipeline.GatherHDR(ctx)
+	} else {
+		metricFamilies, err = e.pipeline.Gather(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	custom, err := e.pipeline.GatherCustom()
+	if err != nil {
+		return err
+	}
+	payload := e.encode(metricFamilies, custom, time.Now())
+	log.Tracef("OTLP: %d bytes", len(payload))
+	e.queue.enqueue(payload)
+	return nil
+}
+
+// encode builds an ExportMetricsServiceRequest protobuf message.
+func (e *OTLPExporter) encode(
+	metricFamilies map[string]*dto.MetricFamily, custom []*dto.MetricFamily, now time.Time,
+) []byte {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	scope := appendString(nil, 1, otlpScopeName)
+	var scopeMetrics []byte
+	scopeMetrics = appendMessage(scopeMetrics, 1, scope)
+	for _, name := range names {
+		scopeMetrics = appendMessage(scopeMetrics, 2,
+			e.encodeMetric(metricFamilies[name], e.config.ExponentialHistograms, now))
+	}
+	for _, mf := range custom {
+		scopeMetrics = appendMessage(scopeMetrics, 2, e.encodeMetric(mf, false, now))
+	}
+
+	var resource []byte
+	for _, a := range e.attributes {
+		resource = appendMessage(resource, 1, encodeKeyValue(a))
+	}
+	var resourceMetrics []byte
+	resourceMetrics = appendMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendMessage(resourceMetrics, 2, scopeMetrics)
+	return appendMessage(nil, 1, resourceMetrics)
+}
+
+// encodeMetric encodes a metric family as an OTLP Metric message.
+func (e *OTLPExporter) encodeMetric(mf *dto.MetricFamily, exponential bool, now time.Time) []byte {
+	var res []byte
+	res = appendString(res, 1, mf.GetName())
+	if mf.GetHelp() != "" {
+		res = appendString(res, 2, mf.GetHelp())
+	}
+	var data []byte
+	for _, m := range mf.Metric {
+		ts := uint64(now.UnixNano())
+		if m.TimestampMs != nil {
+			ts = uint64(m.GetTimestampMs()) * uint64(time.Millisecond)
+		}
+		start := uint64(e.start.UnixNano())
+		var dp []byte
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			dp = encodeNumberDataPoint(m.Label, start, ts, m.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			dp = encodeNumberDataPoint(m.Label, start, ts, m.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			dp = encodeNumberDataPoint(m.Label, start, ts, m.GetUntyped().GetValue())
+		case dto.MetricType_SUMMARY:
+			dp = encodeSummaryDataPoint(m.Label, start, ts, m.GetSummary())
+		case dto.MetricType_HISTOGRAM:
+			if exponential {
+				dp = e.encodeExponentialDataPoint(m.Label, start, ts, m.GetHistogram())
+			} else {
+				dp = encodeHistogramDataPoint(m.Label, start, ts, m.GetHistogram())
+			}
+		}
+		data = appendMessage(data, 1, dp)
+	}
+	switch mf.GetType() {
+	case dto.MetricType_COUNTER:
+		data = appendVarint(data, 2, cumulativeTemporality)
+		data = appendVarint(data, 3, 1)
+		res = appendMessage(res, 7, data)
+	case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		res = appendMessage(res, 5, data)
+	case dto.MetricType_SUMMARY:
+		res = appendMessage(res, 11, data)
+	case dto.MetricType_HISTOGRAM:
+		data = appendVarint(data, 2, cumulativeTemporality)
+		if exponential {
+			res = appendMessage(res, 10, data)
+		} else {
+			res = appendMessage(res, 9, data)
+		}
+	}
+	return res
+}
+
+func encodeNumberDataPoint(labels []*dto.LabelPair, start, ts uint64, value float64) []byte {
+	var res []byte
+	res = appendFixed64(res, 2, start)
+	res = appendFixed64(res, 3, ts)
+	res = appendFixed64(res, 4, math.Float64bits(value))
+	return appendAttributes(res, 7, labels)
+}
+
+func encodeSummaryDataPoint(labels []*dto.LabelPair, start, ts uint64, s *dto.Summary) []byte {
+	var res []byte
+	res = appendFixed64(res, 2, start)
+	res = appendFixed64(res, 3, ts)
+	res = appendFixed64(res, 4, s.GetSampleCount())
+	res = appendFixed64(res, 5, math.Float64bits(s.GetSampleSum()))
+	for _, q := range s.GetQuantile() {
+		var qv []byte
+		qv = appendFixed64(qv, 1, math.Float64bits(q.GetQuantile()))
+		qv = appendFixed64(qv, 2, math.Float64bits(q.GetValue()))
+		res = appendMessage(res, 6, qv)
+	}
+	return appendAttributes(res, 7, labels)
+}
+
+// encodeHistogramDataPoint converts the cumulative buckets into explicit bounds
+// and per bucket counts.
+func encodeHistogramDataPoint(labels []*dto.LabelPair, start, ts uint64, h *dto.Histogram) []byte {
+	var bounds, counts []byte
+	var prev uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			break
+		}
+		bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+		counts = protowire.AppendFixed64(counts, delta(b.GetCumulativeCount(), prev))
+		prev = b.GetCumulativeCount()
+	}
+	counts = protowire.AppendFixed64(counts, delta(h.GetSampleCount(), prev))
+	var res []byte
+	res = appendFixed64(res, 2, start)
+	res = appendFixed64(res, 3, ts)
+	res = appendFixed64(res, 4, h.GetSampleCount())
+	res = appendFixed64(res, 5, math.Float64bits(h.GetSampleSum()))
+	res = appendMessage(res, 6, counts)
+	res = appendMessage(res, 7, bounds)
+	return appendAttributes(res, 9, labels)
+}
+
+// encodeExponentialDataPoint maps the HDR buckets into exponential buckets.
+// The count of each HDR bucket is assigned to the exponential bucket that contains
+// its upper bound; the overflow is assigned to the largest bucket.
+func (e *OTLPExporter) encodeExponentialDataPoint(
+	labels []*dto.LabelPair, start, ts uint64, h *dto.Histogram,
+) []byte {
+	div := e.pipeline.Writer().Config.Bucket.UnitDiv()
+	scale := *e.config.Scale
+	factor := math.Ldexp(1, scale)
+	counts := make(map[int]uint64)
+	var zero, prev uint64
+	minIdx, maxIdx := math.MaxInt32, math.MinInt32
+	for _, b := range h.GetBucket() {
+		le := b.GetUpperBound()
+		if math.IsInf(le, 1) {
+			continue
+		}
+		count := delta(b.GetCumulativeCount(), prev)
+		prev = b.GetCumulativeCount()
+		if le <= 0 {
+			zero += count
+			continue
+		}
+		// Bucket i contains the values in (base^i, base^(i+1)], where base = 2^(2^-scale).
+		idx := int(math.Ceil(math.Log2(le/div)*factor)) - 1
+		counts[idx] += count
+		if idx < minIdx {
+			minIdx = idx
+		}
+		if idx > maxIdx {
+			maxIdx = idx
+		}
+	}
+	if overflow := delta(h.GetSampleCount(), prev); overflow > 0 && maxIdx >= minIdx {
+		counts[maxIdx] += overflow
+	}
+	var res []byte
+	res = appendFixed64(res, 2, start)
+	res = appendFixed64(res, 3, ts)
+	res = appendFixed64(res, 4, h.GetSampleCount())
+	res = appendFixed64(res, 5, math.Float64bits(h.GetSampleSum()/div))
+	res = appendVarint(res, 6, protowire.EncodeZigZag(int64(scale)))
+	res = appendFixed64(res, 7, zero)
+	if maxIdx >= minIdx {
+		var packed []byte
+		for i := minIdx; i <= maxIdx; i++ {
+			packed = protowire.AppendVarint(packed, counts[i])
+		}
+		var positive []byte
+		positive = appendVarint(positive, 1, protowire.EncodeZigZag(int64(minIdx)))
+		positive = appendMessage(positive, 2, packed)
+		res = appendMessage(res, 8, positive)
+	}
+	return appendAttributes(res, 1, labels)
+}
+
+// delta returns the difference between two cumulative counts.
+func delta(curr, prev uint64) uint64 {
+	if curr < prev {
+		return 0
+	}
+	return curr - prev
+}
+
+func appendAttributes(b []byte, num protowire.Number, labels []*dto.LabelPair) []byte {
+	for _, l := range labels {
+		b = appendMessage(b, num, encodeKeyValue(label{l.GetName(), l.GetValue()}))
+	}
+	return b
+}
+
+// encodeKeyValue encodes a KeyValue message with a string value.
+func encodeKeyValue(l label) []byte {
+	var value []byte
+	value = appendString(value, 1, l.value)
+	var res []byte
+	res = appendString(res, 1, l.name)
+	return appendMessage(res, 2, value)
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendFixed64(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+	return protowire.AppendFixed64(b, v)
+}
+
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
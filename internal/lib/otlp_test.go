@@ -0,0 +1,168 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"gopkg.in/yaml.v2"
+)
+
+// protoFields is a decoded protobuf message: length delimited fields are kept as bytes,
+// the other fields as their numeric value.
+type protoFields map[protowire.Number][]interface{}
+
+func decodeProto(t *testing.T, buf []byte) protoFields {
+	res := make(protoFields)
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		require.Greater(t, n, 0)
+		buf = buf[n:]
+		var v interface{}
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(buf)
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(buf)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(buf)
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		require.Greater(t, n, 0)
+		res[num] = append(res[num], v)
+		buf = buf[n:]
+	}
+	return res
+}
+
+func (p protoFields) message(t *testing.T, num protowire.Number) protoFields {
+	require.Len(t, p[num], 1)
+	return decodeProto(t, p[num][0].([]byte))
+}
+
+func (p protoFields) string(num protowire.Number) string {
+	if len(p[num]) == 0 {
+		return ""
+	}
+	return string(p[num][0].([]byte))
+}
+
+func receiveOTLP(t *testing.T, config *Config, pipeline *Pipeline) protoFields {
+	received := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		data, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		select {
+		case received <- data:
+		default:
+		}
+	}))
+	t.Cleanup(receiver.Close)
+	config.OTLP.URL = receiver.URL + "/v1/metrics"
+	config.OTLP.Interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewOTLPExporter(config, pipeline).Run(ctx)
+	select {
+	case data := <-received:
+		req := decodeProto(t, data)
+		return req.message(t, 1)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for OTLP export")
+	}
+	return nil
+}
+
+func TestOTLPExport(t *testing.T) {
+	assert := assert.New(t)
+	pipeline := newTestPipeline(t, input)
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "custom_total", Help: "custom"})
+	counter.Add(5)
+	registry.MustRegister(counter)
+	pipeline.Custom = registry
+	config := pipeline.Writer().Config
+	config.OTLP.Cluster = "test"
+
+	resourceMetrics := receiveOTLP(t, config, pipeline)
+	attributes := make(map[string]string)
+	for _, kv := range resourceMetrics.message(t, 1)[1] {
+		f := decodeProto(t, kv.([]byte))
+		attributes[f.string(1)] = f.message(t, 2).string(1)
+	}
+	assert.Equal("test", attributes["cluster"])
+	assert.Equal("metrics-exporter", attributes["service.name"])
+	assert.NotEmpty(attributes["node"])
+
+	scopeMetrics := resourceMetrics.message(t, 2)
+	metrics := scopeMetrics[2]
+	require.Len(t, metrics, 2)
+
+	histogram := decodeProto(t, metrics[0].([]byte))
+	assert.Equal("raft_process_logcommit_latency", histogram.string(1))
+	dp := histogram.message(t, 9).message(t, 1)
+	assert.Equal(uint64(94176681), dp[4][0])
+	// 33 explicit bounds, 34 buckets.
+	assert.Len(dp[7][0], 33*8)
+	assert.Len(dp[6][0], 34*8)
+
+	sum := decodeProto(t, metrics[1].([]byte))
+	assert.Equal("custom_total", sum.string(1))
+	data := sum.message(t, 7)
+	assert.Equal(uint64(cumulativeTemporality), data[2][0])
+	assert.Equal(uint64(1), data[3][0])
+}
+
+func TestOTLPExponentialHistogram(t *testing.T) {
+	assert := assert.New(t)
+	pipeline := newTestPipeline(t, input)
+	config := pipeline.Writer().Config
+	config.OTLP.ExponentialHistograms = true
+
+	resourceMetrics := receiveOTLP(t, config, pipeline)
+	metrics := resourceMetrics.message(t, 2)[2]
+	require.Len(t, metrics, 1)
+	histogram := decodeProto(t, metrics[0].([]byte))
+	dp := histogram.message(t, 10).message(t, 1)
+	assert.Equal(uint64(94176681), dp[4][0])
+	assert.Equal(protowire.EncodeZigZag(defaultExponentialScale), dp[6][0])
+	positive := dp.message(t, 8)
+	// The smallest HDR bucket upper bound is 69631ns; log2(69631)*8 = 128.7
+	assert.Equal(protowire.EncodeZigZag(128), positive[1][0])
+	packed := positive[2][0].([]byte)
+	var total uint64
+	for len(packed) > 0 {
+		v, n := protowire.ConsumeVarint(packed)
+		require.Greater(t, n, 0)
+		total += v
+		packed = packed[n:]
+	}
+	assert.Equal(uint64(94176681), total)
+
+	// Scale 0 can be configured, as it is distinct from the default.
+	var otlp struct{ OTLP OTLP }
+	require.NoError(t, yaml.UnmarshalStrict([]byte("otlp:\n  scale: 0\n"), &otlp))
+	config.OTLP.Scale = otlp.OTLP.Scale
+	require.NotNil(t, config.OTLP.Scale)
+	resourceMetrics = receiveOTLP(t, config, pipeline)
+	histogram = decodeProto(t, resourceMetrics.message(t, 2)[2][0].([]byte))
+	dp = histogram.message(t, 10).message(t, 1)
+	assert.Equal(uint64(0), dp[6][0])
+	// log2(69631) = 16.09
+	assert.Equal(protowire.EncodeZigZag(16), dp.message(t, 8)[1][0])
+}
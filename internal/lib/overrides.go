@@ -0,0 +1,352 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml3 "gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables that override the
+// configuration settings (e.g. METRICS_EXPORTER_CONFIG_BUCKET_STARTNS for bucket.startns).
+// With the _FILE suffix, the value is read from the file (e.g. a mounted secret).
+// The prefix does not collide with the variables that Kubernetes adds for a service
+// named metrics-exporter (e.g. METRICS_EXPORTER_PORT=tcp://10.96.0.12:8080).
+const EnvPrefix = "METRICS_EXPORTER_CONFIG_"
+
+const envFileSuffix = "_FILE"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ConfigKeys returns the keys of the settings that can be overridden with
+// the environment variables and the command line flags (e.g. bucket.startns).
+// The lists of sections (e.g. targets) and the maps (e.g. labels) can only be
+// configured in the configuration file.
+func ConfigKeys() []string {
+	var keys []string
+	collectKeys(reflect.TypeOf(Config{}), "", &keys)
+	sort.Strings(keys)
+	return keys
+}
+
+// EnvName returns the environment variable that overrides the setting.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func collectKeys(t reflect.Type, prefix string, keys *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, inline := yamlName(field)
+		if name == "-" {
+			continue
+		}
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case inline:
+			collectKeys(ft, prefix, keys)
+		case ft.Kind() == reflect.Struct:
+			collectKeys(ft, joinPath(prefix, name), keys)
+		case settable(ft):
+			*keys = append(*keys, joinPath(prefix, name))
+		}
+	}
+}
+
+// yamlName returns the key of the field in the configuration file, and whether
+// the field is inlined in the parent section.
+func yamlName(field reflect.StructField) (string, bool) {
+	if field.PkgPath != "" {
+		return "-", false
+	}
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	for _, flag := range tag[1:] {
+		if flag == "inline" {
+			return "", true
+		}
+	}
+	if tag[0] != "" {
+		return tag[0], false
+	}
+	return strings.ToLower(field.Name), false
+}
+
+func settable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String || t.Elem().Kind() == reflect.Float64
+	}
+	return false
+}
+
+// Set overrides the setting with the key (e.g. bucket.startns) with the value.
+// The list values are comma separated.
+func (c *Config) Set(key string, value string) error {
+	if err := setValue(reflect.ValueOf(c).Elem(), strings.Split(key, "."), value); err != nil {
+		return &fieldError{path: key, err: err}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, path []string, value string) error {
+	field, ok := findField(v, path[0])
+	if !ok {
+		return errors.New("Unknown setting")
+	}
+	if field.Kind() == reflect.Ptr {
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		field = field.Elem()
+	}
+	if len(path) > 1 {
+		if field.Kind() != reflect.Struct {
+			return errors.New("Unknown setting")
+		}
+		return setValue(field, path[1:], value)
+	}
+	if field.Kind() == reflect.Struct || !settable(field.Type()) {
+		return errors.New("The setting can only be configured in the configuration file")
+	}
+	return parseValue(field, value)
+}
+
+// findField returns the field of the struct with the yaml key, looking into the
+// inlined fields.
+func findField(v reflect.Value, key string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, inline := yamlName(t.Field(i))
+		switch {
+		case inline:
+			if field, ok := findField(v.Field(i), key); ok {
+				return field, true
+			}
+		case name == key:
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func parseValue(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("Invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		if value != "" {
+			items = strings.Split(value, ",")
+		}
+		list := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := parseValue(list.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		field.Set(list)
+	}
+	return nil
+}
+
+// applyEnv overrides the settings with the METRICS_EXPORTER_CONFIG_ environment variables.
+// The unknown variables are ignored.
+func (c *Config) applyEnv(environ []string) error {
+	names := make(map[string]string)
+	for _, key := range ConfigKeys() {
+		names[EnvName(key)] = key
+	}
+	// The variables are sorted, so that the problems are reported in a stable order.
+	environ = append([]string(nil), environ...)
+	sort.Strings(environ)
+	var errs ConfigErrors
+	for _, env := range environ {
+		name, value := env, ""
+		if i := strings.Index(env, "="); i >= 0 {
+			name, value = env[:i], env[i+1:]
+		}
+		if !strings.HasPrefix(name, EnvPrefix) {
+			continue
+		}
+		key, ok := names[name]
+		if !ok && strings.HasSuffix(name, envFileSuffix) {
+			if key, ok = names[strings.TrimSuffix(name, envFileSuffix)]; ok {
+				data, err := os.ReadFile(value)
+				if err != nil {
+					errs.add(name, err)
+					continue
+				}
+				value = strings.TrimSpace(string(data))
+			}
+		}
+		if !ok {
+			log.Debugf("Ignoring %s, not a configuration setting", name)
+			continue
+		}
+		errs.add(name, setValue(reflect.ValueOf(c).Elem(), strings.Split(key, "."), value))
+	}
+	return errs.err()
+}
+
+// variableRef matches the ${VAR} and ${VAR:-default} references, and the escaped $${...}.
+var variableRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces the ${VAR} references in the values of the configuration file
+// with the value of the environment variables. ${VAR:-default} provides a default value,
+// $${VAR} is left as ${VAR}. Only the braced form is expanded, since $ is common
+// in the file (e.g. in the password hashes).
+// The references are expanded in the decoded values, rather than in the text, so
+// that the comments are not expanded, and the values are quoted as needed
+// (e.g. a password with a # or a newline). The plain values are resolved again
+// after the expansion, so that port: ${PORT} is a number, unless the setting is a
+// string (e.g. a password set to null stays the string "null").
+func expandEnv(data []byte) ([]byte, error) {
+	var doc yaml3.Node
+	if err := yaml3.Unmarshal(data, &doc); err != nil {
+		// The syntax errors are reported when the configuration is decoded.
+		return data, nil
+	}
+	var errs ConfigErrors
+	if !expandNode(&doc, reflect.TypeOf(Config{}), "", &errs) {
+		return data, errs.err()
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	return yaml3.Marshal(&doc)
+}
+
+// expandNode expands the references in the scalar values, and returns whether
+// any value was changed. t is the type of the setting decoded from the node, if known:
+// the plain values of the string settings stay strings (e.g. a password set to null).
+func expandNode(node *yaml3.Node, t reflect.Type, path string, errs *ConfigErrors) bool {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	changed := false
+	switch node.Kind {
+	case yaml3.DocumentNode, yaml3.SequenceNode:
+		childType := t
+		if node.Kind == yaml3.SequenceNode {
+			childType = elemType(t)
+		}
+		for i, child := range node.Content {
+			childPath := path
+			if node.Kind == yaml3.SequenceNode {
+				childPath = fmt.Sprintf("%s[%d]", path, i)
+			}
+			changed = expandNode(child, childType, childPath, errs) || changed
+		}
+	case yaml3.MappingNode:
+		// The keys are not expanded.
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			var childType reflect.Type
+			if t != nil && t.Kind() == reflect.Struct {
+				childType = fieldType(t, key)
+			} else {
+				childType = elemType(t)
+			}
+			changed = expandNode(node.Content[i+1], childType, joinPath(path, key), errs) || changed
+		}
+	case yaml3.ScalarNode:
+		if !variableRef.MatchString(node.Value) {
+			return false
+		}
+		isString := node.ShortTag() == "!!str"
+		node.Value = variableRef.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if ref[1] == '$' {
+				return ref[1:]
+			}
+			match := variableRef.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(match[1]); ok {
+				return value
+			}
+			if strings.Contains(ref, ":-") {
+				return match[3]
+			}
+			errs.add(path, fmt.Errorf("Environment variable %s is not set", match[1]))
+			return ""
+		})
+		if node.Style == 0 && !(isString && t != nil && t.Kind() == reflect.String) {
+			// The other plain values are resolved again, e.g. as a number.
+			node.Tag = ""
+		}
+		return true
+	}
+	return changed
+}
+
+// fieldType returns the type of the field of the struct with the yaml key, looking
+// into the inlined fields, or nil if there is none.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		name, inline := yamlName(t.Field(i))
+		switch {
+		case inline:
+			inlined := t.Field(i).Type
+			if inlined.Kind() == reflect.Ptr {
+				inlined = inlined.Elem()
+			}
+			if ft := fieldType(inlined, key); ft != nil {
+				return ft
+			}
+		case name == key:
+			return t.Field(i).Type
+		}
+	}
+	return nil
+}
+
+// elemType returns the type of the elements of a list or a map, or nil.
+func elemType(t reflect.Type) reflect.Type {
+	if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Map) {
+		return t.Elem()
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigKeys(t *testing.T) {
+	assert := assert.New(t)
+	keys := ConfigKeys()
+	for _, key := range []string{
+		"bucket.startns", "port", "url", "tls.ca", "upstream.tls.ca", "server.tls.allowedclients",
+		"custom.url", "custom.passwordfile", "otlp.url", "otlp.username", "shutdowngrace",
+	} {
+		assert.Contains(keys, key)
+	}
+	// The lists of sections and the maps are not included.
+	assert.NotContains(keys, "targets")
+	assert.NotContains(keys, "otlp.headers")
+	assert.NotContains(keys, "server.auth")
+	assert.Equal("METRICS_EXPORTER_CONFIG_UPSTREAM_TLS_CA", EnvName("upstream.tls.ca"))
+}
+
+func TestConfigOverrides(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	location := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(location, []byte(`
+url: ${TEST_EXPORTER_URL}
+port: ${TEST_EXPORTER_PORT:-8080}
+bucket:
+  startns: 1000
+  bins: 10
+  exclude: ^sql_$${SUFFIX}
+custom:
+  url: postgresql://root@localhost:26257
+server:
+  auth:
+    - endpoints: [/_status/vars]
+      users:
+        - username: prometheus
+          passwordhash: $2a$04$RzlRs7bDnEWeCCHTqzNgi.Xh.M6fUGtPaLbCGpzHrkUNT4.4Htw3S
+`), 0600))
+	secret := filepath.Join(dir, "url")
+	require.NoError(t, os.WriteFile(secret, []byte("postgresql://root:secret@db:26257\n"), 0600))
+	t.Setenv("TEST_EXPORTER_URL", "http://localhost:8080/_status/vars")
+	t.Setenv("METRICS_EXPORTER_CONFIG_BUCKET_BINS", "20")
+	t.Setenv("METRICS_EXPORTER_CONFIG_BUCKET_STARTNS", "2000")
+	t.Setenv("METRICS_EXPORTER_CONFIG_CACHETTL", "5s")
+	t.Setenv("METRICS_EXPORTER_CONFIG_CUSTOM_URL_FILE", secret)
+	t.Setenv("METRICS_EXPORTER_CONFIG_UPSTREAM_TLS_CA", "ca.crt")
+
+	config, err := LoadConfigWithOverrides(location, map[string]string{
+		"bucket.bins":   "30",
+		"otlp.url":      "http://collector:4318/v1/metrics",
+		"otlp.headers":  "",
+		"tenants.names": "app, system",
+	})
+	assert.EqualError(err, location+": otlp.headers: "+
+		"The setting can only be configured in the configuration file")
+	assert.Nil(config)
+
+	config, err = LoadConfigWithOverrides(location, map[string]string{
+		"bucket.bins":   "30",
+		"otlp.url":      "http://collector:4318/v1/metrics",
+		"tenants.names": "app, system",
+	})
+	require.NoError(t, err)
+	assert.Equal("http://localhost:8080/_status/vars", config.URL)
+	assert.Equal(8080, config.Port)
+	assert.Equal("^sql_${SUFFIX}", config.Bucket.Exclude)
+	assert.Equal(
+		"$2a$04$RzlRs7bDnEWeCCHTqzNgi.Xh.M6fUGtPaLbCGpzHrkUNT4.4Htw3S",
+		config.Server.Auth[0].Users[0].PasswordHash)
+	// The flags take precedence over the environment.
+	assert.Equal(30, config.Bucket.Bins)
+	assert.Equal(2000, config.Bucket.Startns)
+	assert.Equal(5*time.Second, config.CacheTTL)
+	assert.Equal("postgresql://root:secret@db:26257", config.Custom.URL)
+	assert.Equal(&TLSConfig{Ca: "ca.crt"}, config.Upstream.TLS)
+	assert.Equal("http://collector:4318/v1/metrics", config.OTLP.URL)
+	assert.Equal([]string{"app", "system"}, config.Tenants.Names)
+
+	// The configuration can be built without a file.
+	t.Setenv("METRICS_EXPORTER_CONFIG_URL", "http://localhost:8080/_status/vars")
+	config, err = LoadConfigWithOverrides("", map[string]string{"port": "9090"})
+	require.NoError(t, err)
+	assert.Equal(9090, config.Port)
+	assert.Equal(20, config.Bucket.Bins)
+
+	// The variables that Kubernetes adds for a metrics-exporter service are ignored,
+	// as the unknown settings.
+	t.Setenv("METRICS_EXPORTER_PORT", "tcp://10.96.0.12:8080")
+	t.Setenv("METRICS_EXPORTER_SERVICE_HOST", "10.96.0.12")
+	t.Setenv("METRICS_EXPORTER_PORT_8080_TCP_PORT", "8080")
+	t.Setenv("METRICS_EXPORTER_CONFIG_BUKET_BINS", "10")
+	config, err = LoadConfigWithOverrides("", map[string]string{"port": "9090"})
+	require.NoError(t, err)
+	assert.Equal(9090, config.Port)
+
+	t.Setenv("METRICS_EXPORTER_CONFIG_PORT", "http")
+	_, err = LoadConfig("")
+	assert.EqualError(err, `2 problems found:
+  METRICS_EXPORTER_CONFIG_PORT: Invalid integer "http"
+  port: Invalid port range`)
+}
+
+func TestExpandEnv(t *testing.T) {
+	assert := assert.New(t)
+	t.Setenv("TEST_EXPORTER_HOST", "db")
+	res, err := expandEnv([]byte("url: postgresql://${TEST_EXPORTER_HOST}:${TEST_EXPORTER_PORT:-26257} $PATH $${HOME}"))
+	require.NoError(t, err)
+	assert.Equal("url: postgresql://db:26257 $PATH ${HOME}\n", string(res))
+	_, err = expandEnv([]byte("custom:\n  url: ${TEST_EXPORTER_UNSET}"))
+	assert.EqualError(err, "custom.url: Environment variable TEST_EXPORTER_UNSET is not set")
+
+	// The comments are not expanded, and the file is unchanged without references.
+	data := []byte("# url: ${TEST_EXPORTER_UNSET}\nport: 8080\n")
+	res, err = expandEnv(data)
+	require.NoError(t, err)
+	assert.Equal(data, res)
+
+	// The values with special characters are quoted, the plain values keep their type.
+	dir := t.TempDir()
+	location := filepath.Join(dir, "config.yaml")
+	require.NoError(t, os.WriteFile(location, []byte(`
+# The port defaults to ${TEST_EXPORTER_UNSET:-8080}, see ${TEST_EXPORTER_DOCS}.
+url: http://localhost:8080/_status/vars
+port: ${TEST_EXPORTER_PORT}
+bucket:
+  startns: 1000
+  bins: 10
+custom:
+  url: ${TEST_EXPORTER_DSN}
+otlp:
+  url: http://collector:4318/v1/metrics
+  username: crdb
+  password: ${TEST_EXPORTER_PASSWORD}
+`), 0600))
+	t.Setenv("TEST_EXPORTER_PORT", "9090")
+	t.Setenv("TEST_EXPORTER_DSN", "postgresql://root@db:26257 # comment")
+	t.Setenv("TEST_EXPORTER_PASSWORD", "s3cr3t: #1\nbucket: {}")
+	config, err := LoadConfig(location)
+	require.NoError(t, err)
+	assert.Equal(9090, config.Port)
+	assert.Equal(10, config.Bucket.Bins)
+	assert.Equal("postgresql://root@db:26257 # comment", config.Custom.URL)
+	assert.Equal("s3cr3t: #1\nbucket: {}", config.OTLP.Password)
+
+	// The string settings keep the values that would be resolved as null.
+	for _, value := range []string{"null", "~", ""} {
+		t.Setenv("TEST_EXPORTER_PASSWORD", value)
+		config, err = LoadConfig(location)
+		require.NoError(t, err)
+		assert.Equal(value, config.OTLP.Password)
+		assert.Equal(9090, config.Port)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pipeline reads the metrics from a Source (usually CockroachDB) and translates them
+// according to the configuration. It is shared by the HTTP endpoints and the push sinks.
+// Custom is the optional registry for the custom metrics.
+// Status, if set, tracks the outcome of the last read.
+// Concurrent reads are coalesced into a single upstream scrape, and the
+// translated metrics are cached for TTL. The cached metric families are shared,
+// and must not be modified by the callers.
+// Like the MetricsReader, the pipeline keeps the upstream timeout it was created
+// with: the upstream settings are applied only after a restart.
+type Pipeline struct {
+	Source Source
+	Custom prometheus.Gatherer
+	Status *Status
+	TTL    time.Duration
+
+	timeout    time.Duration
+	mu         sync.Mutex
+	flight     *flight
+	writer     *MetricsWriter
+	generation int
+	cached     map[string]*dto.MetricFamily
+	readAt     time.Time
+}
+
+// CreatePipeline instantiates a new Pipeline
+func CreatePipeline(source Source, writer *MetricsWriter) *Pipeline {
+	return &Pipeline{
+		Source:  source,
+		TTL:     writer.Config.CacheTTL,
+		timeout: writer.Config.Upstream.withDefaults().Timeout,
+		writer:  writer,
+	}
+}
+
+// Writer returns the MetricsWriter used to translate the metrics.
+func (p *Pipeline) Writer() *MetricsWriter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.writer
+}
+
+// SetWriter replaces the MetricsWriter, e.g. when the configuration is reloaded.
+// The cached metrics, translated by the previous writer, are discarded.
+func (p *Pipeline) SetWriter(writer *MetricsWriter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.writer = writer
+	p.TTL = writer.Config.CacheTTL
+	p.generation++
+	p.cached = nil
+}
+
+// Gather reads the metrics and returns the translated metric families.
+func (p *Pipeline) Gather(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	metricFamilies, _, err := p.GatherCached(ctx)
+	return metricFamilies, err
+}
+
+// GatherCached returns the translated metric families, and the time they were read.
+// If the cached metrics are older than the TTL, the metrics are read again;
+// concurrent callers wait for the same read. The read is bounded by the upstream
+// timeout, and by the deadline of the caller that starts it, so that the partial
+// results are returned in time for that caller; it is not canceled with the callers.
+// A caller that gives up returns the context error, without affecting the others.
+func (p *Pipeline) GatherCached(
+	ctx context.Context,
+) (map[string]*dto.MetricFamily, time.Time, error) {
+	p.mu.Lock()
+	if metricFamilies, readAt, ok := p.lookupLocked(); ok {
+		p.mu.Unlock()
+		return metricFamilies, readAt, nil
+	}
+	f := p.flight
+	if f == nil {
+		deadline := time.Now().Add(p.timeout)
+		d, callerBound := ctx.Deadline()
+		if callerBound = callerBound && d.Before(deadline); callerBound {
+			deadline = d
+		}
+		f = &flight{done: make(chan struct{})}
+		p.flight = f
+		go p.refresh(f, deadline, callerBound)
+	}
+	p.mu.Unlock()
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return nil, time.Time{}, f.err
+		}
+		return f.metricFamilies, f.readAt, nil
+	case <-ctx.Done():
+		return nil, time.Time{}, ctx.Err()
+	}
+}
+
+// flight is a read in progress, shared by the concurrent callers.
+// The result is set before done is closed.
+type flight struct {
+	done           chan struct{}
+	metricFamilies map[string]*dto.MetricFamily
+	readAt         time.Time
+	err            error
+}
+
+// refresh reads and translates the metrics before the deadline, and caches them.
+// callerBound is true if the deadline is the one of the caller that started the read.
+func (p *Pipeline) refresh(f *flight, deadline time.Time, callerBound bool) {
+	defer close(f.done)
+	p.mu.Lock()
+	writer, generation := p.writer, p.generation
+	p.mu.Unlock()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	readAt := time.Now()
+	metricFamilies, err := p.read(ctx)
+	// The read is not canceled with the callers. A read cut short by the deadline of
+	// the caller (e.g. a short scrape timeout), earlier than the upstream timeout,
+	// does not tell if the upstream is healthy.
+	if !callerBound || !IsTimeout(err) {
+		p.Status.Set(err)
+	}
+	if err == nil {
+		observeFamilies("in", metricFamilies)
+		err = writer.TranslateMetrics(ctx, metricFamilies)
+	}
+	if err == nil {
+		observeFamilies("out", metricFamilies)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flight = nil
+	if err != nil {
+		f.err = err
+		return
+	}
+	// Not caching the metrics translated by a writer that has been replaced.
+	if p.generation == generation {
+		p.cached, p.readAt = metricFamilies, readAt
+	}
+	f.metricFamilies, f.readAt = metricFamilies, readAt
+}
+
+// read reads the metrics. If the context has a deadline, a fraction of the remaining
+// time is reserved for the translation, so that the partial results of the targets
+// that responded in time can still be returned.
+func (p *Pipeline) read(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		reserve := time.Until(deadline) / translationReserve
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline.Add(-reserve))
+		defer cancel()
+	}
+	return p.Source.ReadMetrics(ctx)
+}
+
+// translationReserve is the fraction (1/n) of the time to respond reserved for the translation.
+const translationReserve = 10
+
+// CacheAgeHeader reports the age of the metrics, in seconds, with millisecond precision.
+const CacheAgeHeader = "X-Metrics-Exporter-Cache-Age"
+
+// SetCacheHeaders sets the headers that report how old the metrics are:
+// Age (in whole seconds), Last-Modified and CacheAgeHeader.
+func SetCacheHeaders(h http.Header, readAt time.Time) {
+	age := time.Since(readAt)
+	h.Set("Age", strconv.Itoa(int(age/time.Second)))
+	h.Set("Last-Modified", readAt.UTC().Format(http.TimeFormat))
+	h.Set(CacheAgeHeader, strconv.FormatFloat(age.Seconds(), 'f', 3, 64))
+}
+
+// lookupLocked returns the cached metrics, if they are not older than the TTL.
+// The caller must hold the lock.
+func (p *Pipeline) lookupLocked() (map[string]*dto.MetricFamily, time.Time, bool) {
+	if p.cached == nil || time.Since(p.readAt) >= p.TTL {
+		return nil, time.Time{}, false
+	}
+	return p.cached, p.readAt, true
+}
+
+// GatherHDR reads the metrics and drops the excluded histograms, leaving the
+// HDR histograms untranslated.
+func (p *Pipeline) GatherHDR(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	metricFamilies, err := p.Source.ReadMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	observeFamilies("in", metricFamilies)
+	writer := p.Writer()
+	for name, mf := range metricFamilies {
+		if mf.GetType() == dto.MetricType_HISTOGRAM && writer.excluded(mf) {
+			delete(metricFamilies, name)
+		}
+	}
+	observeFamilies("out", metricFamilies)
+	return metricFamilies, nil
+}
+
+// GatherCustom returns the custom metric families, if a custom registry is configured.
+func (p *Pipeline) GatherCustom() ([]*dto.MetricFamily, error) {
+	if p.Custom == nil {
+		return nil, nil
+	}
+	return p.Custom.Gather()
+}
+
+// GatherAll returns the translated metric families, merged with the custom metric families.
+func (p *Pipeline) GatherAll(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	metricFamilies, err := p.Gather(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.MergeCustom(metricFamilies)
+}
+
+// MergeCustom returns a new map with the metric families merged with the
+// custom metric families. The input map is not modified. The custom families
+// with the name of a family of a different type are skipped.
+func (p *Pipeline) MergeCustom(
+	metricFamilies map[string]*dto.MetricFamily,
+) (map[string]*dto.MetricFamily, error) {
+	custom, err := p.GatherCustom()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*dto.MetricFamily, len(metricFamilies)+len(custom))
+	for name, mf := range metricFamilies {
+		res[name] = mf
+	}
+	for _, mf := range custom {
+		name := mf.GetName()
+		existing, ok := res[name]
+		if !ok {
+			res[name] = mf
+			continue
+		}
+		if existing.GetType() != mf.GetType() {
+			log.Warnf("Skipping custom %s: type %s does not match %s", name, mf.GetType(), existing.GetType())
+			continue
+		}
+		res[name] = &dto.MetricFamily{
+			Name:   existing.Name,
+			Help:   existing.Help,
+			Type:   existing.Type,
+			Metric: append(append([]*dto.Metric(nil), existing.Metric...), mf.Metric...),
+		}
+	}
+	return res, nil
+}
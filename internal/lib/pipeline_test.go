@@ -0,0 +1,223 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCountingPipeline returns a pipeline, and the number of requests
+// received by the upstream server. The upstream server waits for
+// the release channel to be closed before responding.
+func newCountingPipeline(
+	t *testing.T, ttl time.Duration, release chan struct{},
+) (*Pipeline, *int32) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte("sql_conns 3\n"))
+	}))
+	t.Cleanup(upstream.Close)
+	config := &Config{
+		URL:      upstream.URL,
+		CacheTTL: ttl,
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	return CreatePipeline(reader, CreateMetricsWriter(config)), &requests
+}
+
+// gatedSource counts the reads, and blocks them until the expected
+// number of callers are waiting for the metrics.
+type gatedSource struct {
+	callers int32
+	pending int32
+	reads   int32
+}
+
+// gather calls Gather on the pipeline, as a pending caller.
+func (s *gatedSource) gather(
+	ctx context.Context, p *Pipeline,
+) (map[string]*dto.MetricFamily, error) {
+	atomic.AddInt32(&s.pending, 1)
+	return p.Gather(ctx)
+}
+
+// ReadMetrics implements Source.
+func (s *gatedSource) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	atomic.AddInt32(&s.reads, 1)
+	for atomic.LoadInt32(&s.pending) < s.callers {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(strings.NewReader("sql_conns 3\n"))
+}
+
+func TestGatherCoalesced(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	// The callers that have not joined the read yet when it completes get the cached
+	// metrics, rather than reading them again.
+	config := &Config{CacheTTL: time.Minute}
+	source := &gatedSource{callers: 10}
+	pipeline := CreatePipeline(source, CreateMetricsWriter(config))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metricFamilies, err := source.gather(ctx, pipeline)
+			assert.NoError(err)
+			assert.Contains(metricFamilies, "sql_conns")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&source.reads))
+
+	// Without a TTL, every sequential read goes upstream.
+	release := make(chan struct{})
+	close(release)
+	pipeline, requests := newCountingPipeline(t, 0, release)
+	for i := int32(1); i <= 2; i++ {
+		_, err := pipeline.Gather(ctx)
+		require.NoError(t, err)
+		assert.Equal(i, atomic.LoadInt32(requests))
+	}
+}
+
+func TestGatherCallerContext(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	pipeline, requests := newCountingPipeline(t, time.Minute, release)
+
+	// The caller that starts the read goes away, the read goes on for the others.
+	canceled, cancel := context.WithCancel(context.Background())
+	go func() {
+		assert.Eventually(func() bool { return atomic.LoadInt32(requests) == 1 },
+			5*time.Second, time.Millisecond)
+		cancel()
+	}()
+	_, err := pipeline.Gather(canceled)
+	assert.Equal(context.Canceled, err)
+	done := make(chan error)
+	go func() {
+		_, err := pipeline.Gather(context.Background())
+		done <- err
+	}()
+	close(release)
+	assert.NoError(<-done)
+	assert.Equal(int32(1), atomic.LoadInt32(requests))
+
+	// A caller does not wait past its own deadline for a read started by another.
+	release = make(chan struct{})
+	defer close(release)
+	pipeline, requests = newCountingPipeline(t, time.Minute, release)
+	go func() { _, _ = pipeline.Gather(context.Background()) }()
+	assert.Eventually(func() bool { return atomic.LoadInt32(requests) == 1 },
+		5*time.Second, time.Millisecond)
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = pipeline.Gather(short)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Less(time.Since(start), time.Second)
+}
+
+func TestGatherUpstreamTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	pipeline, _ := newCountingPipeline(t, 0, release)
+	pipeline.timeout = 20 * time.Millisecond
+
+	// Like the reader, the pipeline keeps its upstream timeout after a reload.
+	pipeline.SetWriter(CreateMetricsWriter(&Config{Upstream: Upstream{Timeout: time.Hour}}))
+	start := time.Now()
+	_, err := pipeline.Gather(context.Background())
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestGatherCached(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	release := make(chan struct{})
+	close(release)
+	pipeline, requests := newCountingPipeline(t, time.Minute, release)
+
+	first, readAt, err := pipeline.GatherCached(ctx)
+	require.NoError(t, err)
+	second, cachedAt, err := pipeline.GatherCached(ctx)
+	require.NoError(t, err)
+	assert.Equal(int32(1), atomic.LoadInt32(requests))
+	assert.Equal(readAt, cachedAt)
+	assert.Equal(first, second)
+
+	// Merging the custom metrics must not modify the cached families.
+	merged, err := pipeline.MergeCustom(first)
+	require.NoError(t, err)
+	merged["other"] = nil
+	assert.NotContains(first, "other")
+
+	// Expired entries are read again.
+	pipeline.TTL = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	_, refreshedAt, err := pipeline.GatherCached(ctx)
+	require.NoError(t, err)
+	assert.Equal(int32(2), atomic.LoadInt32(requests))
+	assert.True(refreshedAt.After(readAt))
+}
+
+func TestMergeCustom(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	close(release)
+	pipeline, _ := newCountingPipeline(t, 0, release)
+	custom := prometheus.NewRegistry()
+	conflicting := prometheus.NewCounter(prometheus.CounterOpts{Name: "sql_conns"})
+	conflicting.Add(7)
+	custom.MustRegister(conflicting, prometheus.NewUntypedFunc(
+		prometheus.UntypedOpts{Name: "custom_value"}, func() float64 { return 1 }))
+	pipeline.Custom = custom
+
+	merged, err := pipeline.GatherAll(context.Background())
+	require.NoError(t, err)
+	// The custom counter does not replace the upstream family.
+	require.Contains(t, merged, "sql_conns")
+	assert.Equal(dto.MetricType_UNTYPED, merged["sql_conns"].GetType())
+	require.Len(t, merged["sql_conns"].Metric, 1)
+	assert.Equal(3.0, merged["sql_conns"].Metric[0].GetUntyped().GetValue())
+	assert.Contains(merged, "custom_value")
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	assert := assert.New(t)
+	h := http.Header{}
+	readAt := time.Now().Add(-2500 * time.Millisecond)
+	SetCacheHeaders(h, readAt)
+	assert.Equal("2", h.Get("Age"))
+	assert.Equal(readAt.UTC().Format(http.TimeFormat), h.Get("Last-Modified"))
+	assert.Regexp(`^2\.5\d\d$`, h.Get(CacheAgeHeader))
+}
@@ -0,0 +1,232 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPushInterval   = 30 * time.Second
+	defaultPushTimeout    = 10 * time.Second
+	defaultPushQueueSize  = 10
+	defaultPushMaxRetries = 3
+	minPushBackoff        = 500 * time.Millisecond
+	maxPushBackoff        = 30 * time.Second
+)
+
+// pushQueue sends payloads to a remote endpoint.
+// Payloads are buffered in a bounded queue; when the queue is full the
+// oldest payload is dropped.
+type pushQueue struct {
+	config  PushEndpoint
+	client  *http.Client
+	headers map[string]string
+	queue   chan []byte
+	// minBackoff is the first delay between the retries.
+	minBackoff time.Duration
+}
+
+// pushError is returned when the remote endpoint rejects a payload.
+type pushError struct {
+	status      int
+	msg         string
+	recoverable bool
+}
+
+func (e *pushError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.msg)
+}
+
+func newPushQueue(config PushEndpoint, headers map[string]string) *pushQueue {
+	if config.Timeout == 0 {
+		config.Timeout = defaultPushTimeout
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultPushQueueSize
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultPushMaxRetries
+	} else if config.MaxRetries < 0 {
+		config.MaxRetries = 0
+	}
+	h := make(map[string]string, len(headers)+len(config.Headers))
+	for k, v := range headers {
+		h[k] = v
+	}
+	for k, v := range config.Headers {
+		h[k] = v
+	}
+	return &pushQueue{
+		config:     config,
+		client:     &http.Client{Timeout: config.Timeout},
+		headers:    h,
+		queue:      make(chan []byte, config.QueueSize),
+		minBackoff: minPushBackoff,
+	}
+}
+
+// runPushLoop calls collect immediately and then at every interval, until the
+// context is done. The queues are drained in the background.
+func runPushLoop(
+	ctx context.Context,
+	name string,
+	interval time.Duration,
+	queues []*pushQueue,
+	collect func(ctx context.Context) error,
+) {
+	for _, q := range queues {
+		go q.run(ctx)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := collect(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Error collecting metrics for %s: %s", name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// enqueue adds a payload to the queue, dropping the oldest one if the queue is full.
+func (q *pushQueue) enqueue(payload []byte) {
+	for {
+		select {
+		case q.queue <- payload:
+			return
+		default:
+		}
+		select {
+		case <-q.queue:
+			log.Warnf("Push queue for %s is full, dropping oldest payload", q.config.URL)
+		default:
+		}
+	}
+}
+
+// run sends the payloads in the queue until the context is done.
+func (q *pushQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-q.queue:
+			if err := q.sendWithRetries(ctx, payload); err != nil && ctx.Err() == nil {
+				log.Errorf("Error pushing metrics to %s: %s", q.config.URL, err)
+			}
+		}
+	}
+}
+
+// sendWithRetries sends the payload, retrying with an exponential backoff
+// on network errors, 5xx and 429 responses.
+func (q *pushQueue) sendWithRetries(ctx context.Context, payload []byte) error {
+	backoff := q.minBackoff
+	var err error
+	for attempt := 0; attempt <= q.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("Retrying push to %s in %s: %s", q.config.URL, backoff, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxPushBackoff {
+				backoff = maxPushBackoff
+			}
+		}
+		err = q.send(ctx, payload)
+		if err == nil {
+			return nil
+		}
+		if perr, ok := err.(*pushError); ok && !perr.recoverable {
+			return err
+		}
+	}
+	return err
+}
+
+func (q *pushQueue) send(ctx context.Context, payload []byte) error {
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, q.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range q.headers {
+		req.Header.Set(k, v)
+	}
+	if err := q.config.Credentials.apply(req); err != nil {
+		return err
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return &pushError{
+		status:      resp.StatusCode,
+		msg:         strings.TrimSpace(string(msg)),
+		recoverable: resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests,
+	}
+}
+
+// apply adds the authentication header to the request.
+func (c Credentials) apply(req *http.Request) error {
+	if c.Username != "" {
+		password, err := readSecret(c.Password, c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.Username, password)
+		return nil
+	}
+	token, err := readSecret(c.BearerToken, c.BearerTokenFile)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		scheme := c.TokenScheme
+		if scheme == "" {
+			scheme = "Bearer"
+		}
+		req.Header.Set("Authorization", scheme+" "+token)
+	}
+	return nil
+}
+
+// readSecret returns the value, if not empty, or the content of the file.
+// The file is read every time, so that rotated secrets are picked up.
+func readSecret(value string, file string) (string, error) {
+	if value != "" || file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
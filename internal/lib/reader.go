@@ -7,52 +7,503 @@
 package lib
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultParallelism = 10
+	instanceLabel      = "instance"
+	tenantLabel        = "tenant"
+	targetUpName       = "metrics_exporter_target_up"
 )
 
 // MetricsReader reads the metrics from a CockroachDB endpoint (/_status/var)
+// If a Recorder is set, the raw scrapes are recorded.
+// If multiple targets are configured, or discovered, they are scraped concurrently and
+// the results are merged, adding the target labels to every series.
+// Failed scrapes are retried within the upstream timeout, and each target has a
+// circuit breaker. Optionally, the last good scrape is served while a target is down.
+// If a session is configured, the reader logs in to the HTTP API with a SQL user.
+// If virtual clusters are configured, or discovered, the metrics of each one of them
+// are scraped from every node, adding the tenant label.
 type MetricsReader struct {
 	Config *Config
 	//SecureCtx *TlsClientContext
 	Transport *http.Transport
+	Recorder  *Recorder
+
+	upstream    Upstream
+	session     *sessionManager
+	mu          sync.RWMutex
+	endpoints   []endpoint
+	tenants     []string
+	targets     []*target
+	multiTarget bool
+}
+
+// endpoint is a node to scrape, with the transport to connect to it.
+type endpoint struct {
+	Target
+	transport *http.Transport
+}
+
+// target is an endpoint scraped by the MetricsReader.
+type target struct {
+	url      string
+	instance string
+	tenant   string
+	labels   []*dto.LabelPair
+	client   *http.Client
+	breaker  *breaker
+
+	mu         sync.Mutex
+	lastGood   []byte
+	lastGoodAt time.Time
 }
 
 // CreateMetricsReader instantiates a new Reader
-func CreateMetricsReader(c *Config, t *http.Transport) *MetricsReader {
-	return &MetricsReader{
+func CreateMetricsReader(c *Config, t *http.Transport) (*MetricsReader, error) {
+	r := &MetricsReader{
 		Config:    c,
 		Transport: t,
+		upstream:  c.Upstream.withDefaults(),
+	}
+	if c.HasSession() {
+		r.session = newSessionManager(c.Session)
 	}
+	r.tenants = c.Tenants.Names
+	if len(c.Targets) == 0 {
+		r.endpoints = []endpoint{{Target: Target{URL: c.URL}, transport: t}}
+		// The url is scraped until the nodes are discovered.
+		r.multiTarget = c.HasDiscovery() || c.HasTenants()
+		r.updateTargets()
+		return r, nil
+	}
+	r.multiTarget = true
+	for _, tc := range c.Targets {
+		transport := t
+		if tc.TLS != nil {
+			var err error
+			transport, err = tc.TLS.GetTransport()
+			if err != nil {
+				return nil, err
+			}
+		}
+		r.endpoints = append(r.endpoints, endpoint{Target: tc, transport: transport})
+	}
+	r.updateTargets()
+	return r, nil
 }
 
-func (r *MetricsReader) fetch(ctx context.Context) (*http.Response, error) {
-	client := http.Client{
-		Transport: r.Transport,
+// newTarget creates a target. The instance label is set to the host of
+// the URL, unless it is specified in the labels. If the tenant is set, the
+// metrics of the virtual cluster are scraped, and the tenant label is added.
+func (r *MetricsReader) newTarget(
+	u string, transport *http.Transport, labels map[string]string, tenant string,
+) *target {
+	name := u
+	if tenant != "" {
+		name = u + " (" + tenant + ")"
+	}
+	t := &target{
+		url:     u,
+		tenant:  tenant,
+		client:  &http.Client{Transport: r.roundTripper(transport), Timeout: r.upstream.Timeout},
+		breaker: newBreaker(name, r.upstream.FailureThreshold, r.upstream.Cooldown),
 	}
+	if parsed, err := url.Parse(u); err == nil {
+		t.instance = parsed.Host
+	}
+	if tenant != "" {
+		t.labels = append(t.labels, &dto.LabelPair{
+			Name:  proto.String(tenantLabel),
+			Value: proto.String(tenant),
+		})
+	}
+	if _, ok := labels[instanceLabel]; !ok {
+		t.labels = append(t.labels, &dto.LabelPair{
+			Name:  proto.String(instanceLabel),
+			Value: proto.String(t.instance),
+		})
+	}
+	for k, v := range labels {
+		if k == tenantLabel && tenant != "" {
+			continue
+		}
+		t.labels = append(t.labels, &dto.LabelPair{Name: proto.String(k), Value: proto.String(v)})
+	}
+	sort.Slice(t.labels, func(i, j int) bool { return t.labels[i].GetName() < t.labels[j].GetName() })
+	return t
+}
+
+// roundTripper returns the transport, wrapped to add the session cookie if needed.
+func (r *MetricsReader) roundTripper(transport *http.Transport) http.RoundTripper {
+	if r.session == nil {
+		return transport
+	}
+	return r.session.wrap(transport)
+}
+
+// key identifies the target by its URL and labels.
+func (t *target) key() string {
+	var b strings.Builder
+	b.WriteString(t.url)
+	for _, l := range t.labels {
+		b.WriteString("|" + l.GetName() + "=" + l.GetValue())
+	}
+	return b.String()
+}
 
-	req, err := http.NewRequest(http.MethodGet, r.Config.URL, nil)
+func (t *target) fetch(ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, t.url, nil)
 	if err != nil {
 		return nil, err
 	}
 	req = req.WithContext(ctx)
-	return client.Do(req)
+	if t.tenant != "" {
+		req.Header.Set(TenantHeader, t.tenant)
+	}
+	return t.client.Do(req)
 }
 
-// ReadMetrics reads the metrics from the endpoint and returns a map of dto.MetricFamily
-func (r *MetricsReader) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
-	data, err := r.fetch(ctx)
+// get returns the body of the response of the target.
+func (t *target) get(ctx context.Context) ([]byte, error) {
+	data, err := t.fetch(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer data.Body.Close()
 	if data.StatusCode != http.StatusOK {
-		return nil, errors.New(data.Status)
+		return nil, &statusError{code: data.StatusCode, status: data.Status}
+	}
+	return ioutil.ReadAll(data.Body)
+}
+
+// setLastGood stores the last good scrape of the target.
+func (t *target) setLastGood(body []byte, ts time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastGood, t.lastGoodAt = body, ts
+}
+
+// stale returns the last good scrape of the target, if it is not older than maxAge.
+func (t *target) stale(maxAge time.Duration) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lastGood == nil || time.Since(t.lastGoodAt) > maxAge {
+		return nil, false
+	}
+	return t.lastGood, true
+}
+
+// ReadMetrics reads the metrics from the endpoint and returns a map of dto.MetricFamily
+func (r *MetricsReader) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	r.mu.RLock()
+	targets, multiTarget := r.targets, r.multiTarget
+	r.mu.RUnlock()
+	if !multiTarget {
+		t := targets[0]
+		metricFamilies, stale, err := r.read(ctx, t)
+		if err != nil {
+			return nil, err
+		}
+		if r.upstream.StaleFor > 0 {
+			staleFamily := newGaugeFamily(upstreamStaleName, staleHelp)
+			addGauge(staleFamily, nil, stale)
+			metricFamilies[upstreamStaleName] = staleFamily
+		}
+		node := t.instance
+		if t.tenant != "" {
+			node += "-" + t.tenant
+		}
+		r.record(node, metricFamilies)
+		return metricFamilies, nil
+	}
+	metricFamilies, err := r.scrapeAll(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+	r.record("targets", metricFamilies)
+	return metricFamilies, nil
+}
+
+// record stores the metrics returned by a read, if the scrapes are captured.
+// In multi-target mode, the merged scrape of all the targets is stored, so
+// that the replay serves all the nodes at once.
+func (r *MetricsReader) record(source string, metricFamilies map[string]*dto.MetricFamily) {
+	if r.Recorder == nil {
+		return
+	}
+	var buf bytes.Buffer
+	err := WriteText(&buf, metricFamilies)
+	if err == nil {
+		err = r.Recorder.Record(source, time.Now(), buf.Bytes())
+	}
+	if err != nil {
+		log.Errorf("Error recording scrape: %s", err)
+	}
+}
+
+// SetTargets replaces the nodes to scrape. Existing targets with
+// the same URL and labels are preserved.
+func (r *MetricsReader) SetTargets(targets []Target) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endpoints = make([]endpoint, 0, len(targets))
+	for _, tc := range targets {
+		r.endpoints = append(r.endpoints, endpoint{Target: tc, transport: r.Transport})
+	}
+	r.multiTarget = true
+	r.updateTargets()
+}
+
+// SetTenants replaces the virtual clusters to scrape. Existing targets with
+// the same URL and labels are preserved.
+func (r *MetricsReader) SetTenants(tenants []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tenants = tenants
+	r.multiTarget = true
+	r.updateTargets()
+}
+
+// updateTargets creates a target for each node, or for each node and
+// virtual cluster, if there are virtual clusters. The caller must hold the lock.
+func (r *MetricsReader) updateTargets() {
+	existing := make(map[string]*target, len(r.targets))
+	for _, t := range r.targets {
+		existing[t.key()] = t
+	}
+	initial := len(r.targets) == 0
+	tenants := r.tenants
+	if len(tenants) == 0 {
+		tenants = []string{""}
+	}
+	res := make([]*target, 0, len(r.endpoints)*len(tenants))
+	for _, e := range r.endpoints {
+		for _, tenant := range tenants {
+			t := r.newTarget(e.URL, e.transport, e.Labels, tenant)
+			if prev, ok := existing[t.key()]; ok {
+				t = prev
+			} else if !initial {
+				log.Infof("Adding target %s", t.breaker.name)
+			}
+			delete(existing, t.key())
+			res = append(res, t)
+		}
 	}
+	for _, t := range existing {
+		log.Infof("Removing target %s", t.breaker.name)
+	}
+	r.targets = res
+}
+
+// read reads the metrics from a single target. If the target cannot be read, and
+// stale-serving is enabled, the last good scrape is returned if it is recent enough;
+// the returned bool is true for stale results.
+func (r *MetricsReader) read(
+	ctx context.Context, t *target,
+) (map[string]*dto.MetricFamily, bool, error) {
 	var parser expfmt.TextParser
-	return parser.TextToMetricFamilies(data.Body)
+	body, err := r.scrapeWithRetries(ctx, t)
+	if err == nil {
+		var metricFamilies map[string]*dto.MetricFamily
+		metricFamilies, err = parser.TextToMetricFamilies(bytes.NewReader(body))
+		if err == nil {
+			if r.upstream.StaleFor > 0 {
+				t.setLastGood(body, time.Now())
+			}
+			return metricFamilies, false, nil
+		}
+		parseErrors.Inc()
+	}
+	body, ok := t.stale(r.upstream.StaleFor)
+	if !ok {
+		return nil, false, err
+	}
+	log.Warnf("Serving stale metrics for %s: %s", t.url, err)
+	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	return metricFamilies, true, err
+}
+
+// scrapeWithRetries scrapes the target, retrying recoverable errors with a jittered
+// backoff, as long as the upstream timeout allows. The outcome is recorded by
+// the circuit breaker of the target.
+func (r *MetricsReader) scrapeWithRetries(ctx context.Context, t *target) ([]byte, error) {
+	if !t.breaker.allow() {
+		return nil, errBreakerOpen
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.upstream.Timeout)
+	defer cancel()
+	var body []byte
+	var err error
+retry:
+	for attempt := 1; ; attempt++ {
+		body, err = r.scrape(ctx, t)
+		if err == nil || attempt > r.upstream.MaxRetries || !retryable(err) || ctx.Err() != nil {
+			break
+		}
+		backoff := r.upstream.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			break
+		}
+		log.Debugf("Retrying scrape of %s in %s: %s", t.url, backoff, err)
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(backoff):
+		}
+	}
+	t.breaker.record(err)
+	return body, err
+}
+
+// scrape returns the raw metrics from a single target.
+func (r *MetricsReader) scrape(ctx context.Context, t *target) ([]byte, error) {
+	start := time.Now()
+	body, err := t.get(ctx)
+	upstreamScrapeDuration.WithLabelValues(t.instance).Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamScrapeErrors.WithLabelValues(t.instance).Inc()
+		return nil, err
+	}
+	upstreamResponseBytes.WithLabelValues(t.instance).Add(float64(len(body)))
+	return body, nil
+}
+
+// scrapeAll scrapes the targets concurrently, with bounded parallelism, and
+// merges the results. Targets that cannot be scraped are skipped, unless a stale
+// scrape is served; the metrics_exporter_target_up gauge reports whether each target
+// was scraped successfully, and metrics_exporter_upstream_stale whether its metrics are stale.
+// It returns an error if none of the targets could be scraped.
+func (r *MetricsReader) scrapeAll(
+	ctx context.Context, targets []*target,
+) (map[string]*dto.MetricFamily, error) {
+	parallelism := r.Config.Parallelism
+	if parallelism <= 0 {
+		parallelism = defaultParallelism
+	}
+	sem := make(chan struct{}, parallelism)
+	results := make([]map[string]*dto.MetricFamily, len(targets))
+	stale := make([]bool, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		wg.Add(1)
+		go func(i int, t *target) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			metricFamilies, isStale, err := r.read(ctx, t)
+			if err != nil {
+				log.Warnf("Error scraping %s: %s", t.url, err)
+				errs[i] = err
+				return
+			}
+			results[i], stale[i] = metricFamilies, isStale
+		}(i, t)
+	}
+	wg.Wait()
+
+	var firstErr error
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+		}
+	}
+	if failed == len(targets) && failed > 0 {
+		return nil, fmt.Errorf("None of the %d targets could be scraped: %w", failed, firstErr)
+	}
+
+	merged := make(map[string]*dto.MetricFamily)
+	up := newGaugeFamily(targetUpName, "Whether the target was scraped successfully")
+	staleFamily := newGaugeFamily(upstreamStaleName, staleHelp)
+	for i, t := range targets {
+		if results[i] != nil {
+			mergeFamilies(merged, results[i], t.labels)
+		}
+		addGauge(up, t.labels, results[i] != nil && !stale[i])
+		addGauge(staleFamily, t.labels, stale[i])
+	}
+	merged[targetUpName] = up
+	if r.upstream.StaleFor > 0 {
+		merged[upstreamStaleName] = staleFamily
+	}
+	return merged, nil
+}
+
+const staleHelp = "Whether the last good scrape is served, since the target cannot be scraped"
+
+func newGaugeFamily(name string, help string) *dto.MetricFamily {
+	return &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+}
+
+// addGauge adds a 0/1 gauge to the family, copying the labels.
+func addGauge(mf *dto.MetricFamily, labels []*dto.LabelPair, value bool) {
+	v := 0.0
+	if value {
+		v = 1
+	}
+	mf.Metric = append(mf.Metric, &dto.Metric{
+		Label: append([]*dto.LabelPair(nil), labels...),
+		Gauge: &dto.Gauge{Value: proto.Float64(v)},
+	})
+}
+
+// mergeFamilies adds the labels to the metrics, and merges them into dest.
+// Labels already present in a metric are not overwritten.
+func mergeFamilies(
+	dest map[string]*dto.MetricFamily, src map[string]*dto.MetricFamily, labels []*dto.LabelPair,
+) {
+	for name, mf := range src {
+		for _, m := range mf.Metric {
+			m.Label = addLabels(m.Label, labels)
+		}
+		existing, ok := dest[name]
+		if !ok {
+			dest[name] = mf
+			continue
+		}
+		if existing.GetType() != mf.GetType() {
+			log.Warnf("Skipping %s: type %s does not match %s", name, mf.GetType(), existing.GetType())
+			continue
+		}
+		existing.Metric = append(existing.Metric, mf.Metric...)
+	}
+}
+
+func addLabels(current []*dto.LabelPair, labels []*dto.LabelPair) []*dto.LabelPair {
+	res := current
+outer:
+	for _, l := range labels {
+		for _, c := range current {
+			if c.GetName() == l.GetName() {
+				continue outer
+			}
+		}
+		res = append(res, l)
+	}
+	return res
 }
@@ -0,0 +1,107 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiTarget(t *testing.T) {
+	assert := assert.New(t)
+	node1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns 1\n"))
+	}))
+	defer node1.Close()
+	node2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns{node=\"two\"} 2\n"))
+	}))
+	defer node2.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	config := &Config{
+		Targets: []Target{
+			{URL: node1.URL, Labels: map[string]string{"node": "1"}},
+			{URL: node2.URL, Labels: map[string]string{"node": "2"}},
+			{URL: down.URL, Labels: map[string]string{"node": "3"}},
+		},
+		Parallelism: 2,
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	require.Len(t, mfs, 2)
+
+	host := func(u string) string {
+		parsed, err := url.Parse(u)
+		require.NoError(t, err)
+		return parsed.Host
+	}
+	var buf bytes.Buffer
+	_, err = expfmt.MetricFamilyToText(&buf, mfs["sql_conns"])
+	require.NoError(t, err)
+	// Labels already present are not overwritten.
+	assert.Equal(`# TYPE sql_conns gauge
+sql_conns{instance="`+host(node1.URL)+`",node="1"} 1
+sql_conns{node="two",instance="`+host(node2.URL)+`"} 2
+`, buf.String())
+
+	buf.Reset()
+	_, err = expfmt.MetricFamilyToText(&buf, mfs[targetUpName])
+	require.NoError(t, err)
+	assert.Equal(`# HELP metrics_exporter_target_up Whether the target was scraped successfully
+# TYPE metrics_exporter_target_up gauge
+metrics_exporter_target_up{instance="`+host(node1.URL)+`",node="1"} 1
+metrics_exporter_target_up{instance="`+host(node2.URL)+`",node="2"} 1
+metrics_exporter_target_up{instance="`+host(down.URL)+`",node="3"} 0
+`, buf.String())
+}
+
+func TestSingleTargetError(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	reader, err := CreateMetricsReader(&Config{URL: down.URL}, &http.Transport{})
+	require.NoError(t, err)
+	_, err = reader.ReadMetrics(context.Background())
+	assert.EqualError(t, err, "503 Service Unavailable")
+}
+
+func TestMultiTargetAllDown(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	config := &Config{
+		Targets: []Target{
+			{URL: down.URL, Labels: map[string]string{"node": "1"}},
+			{URL: down.URL, Labels: map[string]string{"node": "2"}},
+		},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+
+	// The upstream is failing only if none of the targets could be scraped.
+	pipeline := CreatePipeline(reader, CreateMetricsWriter(&Config{}))
+	pipeline.Status = &Status{}
+	_, err = pipeline.Gather(context.Background())
+	assert.EqualError(t, err, "None of the 2 targets could be scraped: 503 Service Unavailable")
+	assert.Equal(t, StatusFailing, pipeline.Status.report().Status)
+}
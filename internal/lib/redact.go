@@ -0,0 +1,151 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// redacted replaces the secrets, as in url.URL.Redacted.
+const redacted = "xxxxx"
+
+var (
+	// urlPassword matches the scheme://user: prefix of a URL with a password.
+	urlPassword = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^/@\s:]*:)[^@\s/]+@`)
+	// dsnPassword matches the password in a key=value connection string, or in the URL parameters.
+	dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s'"&` + "`]+)")
+	// sensitiveHeader matches the names of the HTTP headers that may carry credentials.
+	sensitiveHeader = regexp.MustCompile(`(?i)auth|token|key|secret|cookie|password`)
+)
+
+// Redact scrubs the passwords of the URLs and of the connection strings in the text.
+func Redact(s string) string {
+	s = urlPassword.ReplaceAllString(s, "${1}"+redacted+"@")
+	return dsnPassword.ReplaceAllString(s, "${1}"+redacted)
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func redactHeaders(headers map[string]string) map[string]string {
+	if headers == nil {
+		return nil
+	}
+	res := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if sensitiveHeader.MatchString(name) {
+			value = redactSecret(value)
+		}
+		res[name] = value
+	}
+	return res
+}
+
+// formatStruct formats the struct as %+v does, without calling its String method:
+// the fields are formatted with their own String methods, if any.
+func formatStruct(v interface{}) string {
+	rv := reflect.ValueOf(v)
+	t := rv.Type()
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		if b.Len() > 1 {
+			b.WriteByte(' ')
+		}
+		field := rv.Field(i)
+		// The optional values (e.g. the OTLP scale) are formatted rather than their address.
+		if field.Kind() == reflect.Ptr && !field.IsNil() && field.Elem().Kind() != reflect.Struct {
+			field = field.Elem()
+		}
+		fmt.Fprintf(&b, "%s:%+v", t.Field(i).Name, field.Interface())
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// String implements fmt.Stringer, redacting the secrets.
+func (c Config) String() string {
+	c.URL = Redact(c.URL)
+	return formatStruct(c)
+}
+
+// String implements fmt.Stringer, redacting the password of the URL.
+func (t Target) String() string {
+	t.URL = Redact(t.URL)
+	return formatStruct(t)
+}
+
+// String implements fmt.Stringer, redacting the password of the URL.
+func (c Custom) String() string {
+	c.URL = Redact(c.URL)
+	return formatStruct(c)
+}
+
+// String implements fmt.Stringer, redacting the password hash.
+func (u BasicUser) String() string {
+	u.PasswordHash = redactSecret(u.PasswordHash)
+	return formatStruct(u)
+}
+
+// String implements fmt.Stringer, redacting the password and the token.
+func (c Credentials) String() string {
+	c.Password, c.BearerToken = redactSecret(c.Password), redactSecret(c.BearerToken)
+	return formatStruct(c)
+}
+
+// String implements fmt.Stringer, redacting the URL password, the credentials
+// and the headers that may carry credentials.
+func (e PushEndpoint) String() string {
+	e.URL = Redact(e.URL)
+	e.Headers = redactHeaders(e.Headers)
+	return formatStruct(e)
+}
+
+// String implements fmt.Stringer. Without it, the PushEndpoint one would be used.
+func (o OTLP) String() string {
+	return formatStruct(o)
+}
+
+// String implements fmt.Stringer. Without it, the PushEndpoint one would be used.
+func (i Influx) String() string {
+	return formatStruct(i)
+}
+
+// RedactHook is a logrus hook that scrubs the passwords of the URLs and of the
+// connection strings from the log messages and fields (e.g. the database errors).
+type RedactHook struct{}
+
+// Levels implements log.Hook.
+func (RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements log.Hook.
+func (RedactHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			entry.Data[key] = Redact(value)
+		case error:
+			entry.Data[key] = Redact(value.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// Reloader reloads the configuration on SIGHUP, and when the configuration file changes.
+// A configuration that cannot be read, or is invalid, is rejected, and the current
+// one stays in effect. The bucket settings, the cache ttl, the scrape timeout and
+// the custom metrics settings are applied by the reload hooks; changing the other
+// settings (e.g. the port, the TLS configuration and the targets) requires a restart.
+// Status, if set, tracks the outcome of the last reload. Overrides are the settings
+// set on the command line, applied to every configuration loaded.
+type Reloader struct {
+	Status    *Status
+	Overrides map[string]string
+
+	location string
+	interval time.Duration
+
+	mu      sync.Mutex
+	config  *Config
+	modTime time.Time
+	hooks   []func(config *Config)
+}
+
+// NewReloader instantiates a Reloader, for the configuration read from the location.
+func NewReloader(location string, config *Config) *Reloader {
+	interval := config.ReloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	r := &Reloader{
+		location: location,
+		interval: interval,
+		config:   config,
+	}
+	if info, err := os.Stat(location); err == nil {
+		r.modTime = info.ModTime()
+	}
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+	return r
+}
+
+// Config returns the configuration in effect.
+func (r *Reloader) Config() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+// OnReload registers a hook called with the new configuration, after a successful reload.
+// The hooks must not fail: the new configuration has already been validated.
+func (r *Reloader) OnReload(hook func(config *Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook)
+}
+
+// Run reloads the configuration on SIGHUP, or when the modification time of the file
+// changes, until the context is done.
+func (r *Reloader) Run(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			log.Info("Received SIGHUP, reloading the configuration")
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			log.Infof("%s changed, reloading the configuration", r.location)
+		}
+		if err := r.Reload(); err != nil {
+			log.Error("Error reloading the configuration, keeping the current one: ", err)
+		}
+	}
+}
+
+// Reload reads and validates the configuration, and calls the reload hooks.
+// If the configuration is invalid, the current one stays in effect.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if info, err := os.Stat(r.location); err == nil {
+		r.modTime = info.ModTime()
+	}
+	config, err := LoadConfigWithOverrides(r.location, r.Overrides)
+	r.Status.Set(err)
+	if err != nil {
+		configReloadSuccess.Set(0)
+		return err
+	}
+	if restartRequired(r.config, config) {
+		log.Warn("Some of the changed settings are applied only after a restart")
+	}
+	for _, hook := range r.hooks {
+		hook(config)
+	}
+	r.config = config
+	configReloadSuccess.Set(1)
+	configReloadTimestamp.SetToCurrentTime()
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// changed returns true if the modification time of the file changed since the last reload.
+func (r *Reloader) changed() bool {
+	info, err := os.Stat(r.location)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !info.ModTime().Equal(r.modTime)
+}
+
+// restartRequired returns true if the configurations differ in the settings
+// that are not applied by a reload.
+func restartRequired(current, next *Config) bool {
+	a, b := *current, *next
+	for _, c := range []*Config{&a, &b} {
+		c.Bucket = BucketConfig{}
+		c.CacheTTL = 0
+		c.Scrape = Scrape{}
+		c.Custom.Limit, c.Custom.Frequency = 0, 0
+		c.Custom.SkipActivity, c.Custom.SkipEfficiency = false, false
+	}
+	return !reflect.DeepEqual(a, b)
+}
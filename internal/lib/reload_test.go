@@ -0,0 +1,76 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const reloadConfig = `
+port: 8080
+url: http://localhost:8080/_status/vars
+bucket:
+  bins: 10
+  startns: 1000
+  exclude: %s
+`
+
+func writeConfig(t *testing.T, location string, exclude string) {
+	require.NoError(t, os.WriteFile(location, []byte(fmt.Sprintf(reloadConfig, exclude)), 0600))
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	location := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, location, "^sql_")
+	config, err := LoadConfig(location)
+	require.NoError(t, err)
+	reloader := NewReloader(location, config)
+	assert.False(reloader.changed())
+
+	pipeline := CreatePipeline(&StaticSource{}, CreateMetricsWriter(config))
+	reloader.OnReload(func(config *Config) {
+		pipeline.SetWriter(CreateMetricsWriter(config))
+	})
+
+	// An invalid configuration is rejected.
+	writeConfig(t, location, "(")
+	require.NoError(t, os.Chtimes(location, time.Now(), time.Now().Add(time.Minute)))
+	assert.True(reloader.changed())
+	assert.Error(reloader.Reload())
+	assert.False(reloader.changed())
+	assert.Equal(0.0, testutil.ToFloat64(configReloadSuccess))
+	assert.Same(config, reloader.Config())
+	assert.Equal("^sql_", pipeline.Writer().Exclude.String())
+
+	writeConfig(t, location, "^raft_")
+	require.NoError(t, reloader.Reload())
+	assert.Equal(1.0, testutil.ToFloat64(configReloadSuccess))
+	assert.Equal("^raft_", reloader.Config().Bucket.Exclude)
+	assert.Equal("^raft_", pipeline.Writer().Exclude.String())
+	assert.InDelta(float64(time.Now().Unix()), testutil.ToFloat64(configReloadTimestamp), 5)
+}
+
+func TestRestartRequired(t *testing.T) {
+	assert := assert.New(t)
+	current := &Config{Port: 8080, Bucket: BucketConfig{Bins: 10}}
+	next := *current
+	next.Bucket.Bins = 20
+	next.CacheTTL = time.Second
+	next.Custom.Frequency = 5
+	assert.False(restartRequired(current, &next))
+	next.Port = 8081
+	assert.True(restartRequired(current, &next))
+}
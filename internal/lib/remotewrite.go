@@ -0,0 +1,176 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+var remoteWriteHeaders = map[string]string{
+	"Content-Encoding":                  "snappy",
+	"Content-Type":                      "application/x-protobuf",
+	"User-Agent":                        "metrics-exporter",
+	"X-Prometheus-Remote-Write-Version": "0.1.0",
+}
+
+// RemoteWriter periodically collects the metrics and pushes them to
+// the configured endpoints using the Prometheus remote write protocol.
+type RemoteWriter struct {
+	pipeline *Pipeline
+	interval time.Duration
+	queues   []*pushQueue
+}
+
+type label struct {
+	name  string
+	value string
+}
+
+type timeSeries struct {
+	labels    []label
+	value     float64
+	timestamp int64
+}
+
+// NewRemoteWriter instantiates a RemoteWriter
+func NewRemoteWriter(config RemoteWrite, pipeline *Pipeline) *RemoteWriter {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultPushInterval
+	}
+	queues := make([]*pushQueue, 0, len(config.Endpoints))
+	for _, e := range config.Endpoints {
+		queues = append(queues, newPushQueue(e, remoteWriteHeaders))
+	}
+	return &RemoteWriter{
+		pipeline: pipeline,
+		interval: interval,
+		queues:   queues,
+	}
+}
+
+// Run collects and pushes the metrics until the context is done.
+func (w *RemoteWriter) Run(ctx context.Context) {
+	runPushLoop(ctx, "remote write", w.interval, w.queues, w.collect)
+}
+
+// collect gathers the metrics and adds the encoded payload to each queue.
+func (w *RemoteWriter) collect(ctx context.Context) error {
+	metricFamilies, err := w.pipeline.Gather(ctx)
+	if err != nil {
+		return err
+	}
+	series := toTimeSeries(metricFamilies, time.Now().UnixNano()/int64(time.Millisecond))
+	payload := snappy.Encode(nil, encodeWriteRequest(series))
+	log.Tracef("Remote write: %d series, %d bytes", len(series), len(payload))
+	for _, q := range w.queues {
+		q.enqueue(payload)
+	}
+	return nil
+}
+
+// toTimeSeries flattens the metric families into time series, following
+// the Prometheus conventions for histograms and summaries.
+func toTimeSeries(metricFamilies map[string]*dto.MetricFamily, now int64) []timeSeries {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var res []timeSeries
+	for _, name := range names {
+		mf := metricFamilies[name]
+		for _, m := range mf.Metric {
+			ts := now
+			if m.TimestampMs != nil {
+				ts = m.GetTimestampMs()
+			}
+			add := func(suffix string, value float64, extra ...label) {
+				labels := make([]label, 0, len(m.Label)+len(extra)+1)
+				labels = append(labels, label{"__name__", mf.GetName() + suffix})
+				for _, l := range m.Label {
+					labels = append(labels, label{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				res = append(res, timeSeries{labels: labels, value: value, timestamp: ts})
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.GetSummary().GetQuantile() {
+					add("", q.GetValue(), label{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", m.GetSummary().GetSampleSum())
+				add("_count", float64(m.GetSummary().GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				infSeen := false
+				for _, b := range m.GetHistogram().GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						infSeen = true
+					}
+					add("_bucket", float64(b.GetCumulativeCount()),
+						label{"le", formatFloat(b.GetUpperBound())})
+				}
+				if !infSeen {
+					add("_bucket", float64(m.GetHistogram().GetSampleCount()),
+						label{"le", formatFloat(math.Inf(1))})
+				}
+				add("_sum", m.GetHistogram().GetSampleSum())
+				add("_count", float64(m.GetHistogram().GetSampleCount()))
+			}
+		}
+	}
+	return res
+}
+
+// encodeWriteRequest encodes the time series as a prometheus.WriteRequest protobuf message.
+func encodeWriteRequest(series []timeSeries) []byte {
+	var buf []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.labels {
+			var lb []byte
+			lb = appendString(lb, 1, l.name)
+			lb = appendString(lb, 2, l.value)
+			ts = appendMessage(ts, 1, lb)
+		}
+		var sample []byte
+		sample = appendFixed64(sample, 1, math.Float64bits(s.value))
+		sample = appendVarint(sample, 2, uint64(s.timestamp))
+		ts = appendMessage(ts, 2, sample)
+		buf = appendMessage(buf, 1, ts)
+	}
+	return buf
+}
+
+// formatFloat formats a float value as in the Prometheus text format.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes a prometheus.WriteRequest protobuf message.
+func decodeWriteRequest(t *testing.T, buf []byte) []timeSeries {
+	var res []timeSeries
+	forEachField(t, buf, func(num protowire.Number, ts []byte) {
+		var s timeSeries
+		forEachField(t, ts, func(num protowire.Number, b []byte) {
+			switch num {
+			case 1:
+				var l label
+				forEachField(t, b, func(num protowire.Number, v []byte) {
+					if num == 1 {
+						l.name = string(v)
+					} else {
+						l.value = string(v)
+					}
+				})
+				s.labels = append(s.labels, l)
+			case 2:
+				for len(b) > 0 {
+					_, typ, n := protowire.ConsumeTag(b)
+					require.Greater(t, n, 0)
+					b = b[n:]
+					switch typ {
+					case protowire.Fixed64Type:
+						v, m := protowire.ConsumeFixed64(b)
+						s.value = math.Float64frombits(v)
+						b = b[m:]
+					case protowire.VarintType:
+						v, m := protowire.ConsumeVarint(b)
+						s.timestamp = int64(v)
+						b = b[m:]
+					default:
+						t.Fatalf("unexpected wire type %d", typ)
+					}
+				}
+			}
+		})
+		res = append(res, s)
+	})
+	return res
+}
+
+// forEachField calls fn for each length delimited field in the message.
+func forEachField(t *testing.T, buf []byte, fn func(protowire.Number, []byte)) {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		require.Greater(t, n, 0)
+		buf = buf[n:]
+		require.Equal(t, protowire.BytesType, typ)
+		v, m := protowire.ConsumeBytes(buf)
+		require.Greater(t, m, 0)
+		fn(num, v)
+		buf = buf[m:]
+	}
+}
+
+func newTestPipeline(t *testing.T, body string) *Pipeline {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	config := &Config{
+		URL: upstream.URL,
+		Bucket: BucketConfig{
+			Startns: 100,
+			Bins:    10,
+		},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	return CreatePipeline(reader, CreateMetricsWriter(config))
+}
+
+func TestRemoteWrite(t *testing.T) {
+	assert := assert.New(t)
+	received := make(chan []timeSeries, 1)
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Failing the first attempt to verify that the payload is retried.
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal("snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal("Bearer secret", r.Header.Get("Authorization"))
+		compressed, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		w.WriteHeader(http.StatusNoContent)
+		select {
+		case received <- decodeWriteRequest(t, data):
+		default:
+		}
+	}))
+	defer receiver.Close()
+
+	pipeline := newTestPipeline(t, input)
+	writer := NewRemoteWriter(RemoteWrite{
+		Interval: time.Hour,
+		Endpoints: []PushEndpoint{{
+			URL:         receiver.URL,
+			Credentials: Credentials{BearerToken: "secret"},
+		}},
+	}, pipeline)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go writer.Run(ctx)
+
+	var series []timeSeries
+	select {
+	case series = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for remote write")
+	}
+	assert.Equal(int32(2), atomic.LoadInt32(&attempts))
+	// 34 translated buckets, including +Inf, plus sum and count.
+	assert.Len(series, 36)
+	first := series[0]
+	assert.Equal([]label{
+		{"__name__", "raft_process_logcommit_latency_bucket"},
+		{"le", "70000"},
+		{"store", "1"}}, first.labels)
+	last := series[len(series)-1]
+	assert.Equal("raft_process_logcommit_latency_count", last.labels[0].value)
+	assert.Equal(float64(9.4176681e+07), last.value)
+}
+
+func TestRemoteWriteNotRecoverable(t *testing.T) {
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+	q := newPushQueue(PushEndpoint{URL: receiver.URL}, remoteWriteHeaders)
+	err := q.sendWithRetries(context.Background(), []byte{})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestPushRetries(t *testing.T) {
+	assert := assert.New(t)
+	var attempts int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+	for _, tc := range []struct {
+		maxRetries int
+		attempts   int32
+	}{
+		{-1, 1},
+		{0, 1 + defaultPushMaxRetries},
+		{1, 2},
+	} {
+		atomic.StoreInt32(&attempts, 0)
+		q := newPushQueue(PushEndpoint{URL: receiver.URL, MaxRetries: tc.maxRetries}, remoteWriteHeaders)
+		q.minBackoff = time.Millisecond
+		assert.Error(q.sendWithRetries(context.Background(), []byte{}))
+		assert.Equal(tc.attempts, atomic.LoadInt32(&attempts), "max retries %d", tc.maxRetries)
+	}
+	assert.EqualError(PushEndpoint{URL: receiver.URL, MaxRetries: -2}.checkConfig(),
+		"maxretries: Invalid max retries")
+}
+
+func TestPushQueueDropsOldest(t *testing.T) {
+	q := newPushQueue(PushEndpoint{URL: "http://localhost", QueueSize: 2}, nil)
+	q.enqueue([]byte("1"))
+	q.enqueue([]byte("2"))
+	q.enqueue([]byte("3"))
+	assert.Equal(t, "2", string(<-q.queue))
+	assert.Equal(t, "3", string(<-q.queue))
+}
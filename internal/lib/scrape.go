@@ -0,0 +1,55 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ScrapeTimeoutHeader is the header Prometheus uses to send the scrape timeout.
+const ScrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+const (
+	defaultScrapeTimeout = 10 * time.Second
+	defaultScrapeMargin  = 500 * time.Millisecond
+)
+
+// TimeoutFor returns the time available to respond to the request: the timeout
+// sent by the scraper, or the configured one, minus the margin. If the timeout is
+// not greater than the margin, half of the timeout is used.
+func (s Scrape) TimeoutFor(r *http.Request) time.Duration {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultScrapeTimeout
+	}
+	if v := r.Header.Get(ScrapeTimeoutHeader); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds > 0 {
+			timeout = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	margin := s.Margin
+	if margin == 0 {
+		margin = defaultScrapeMargin
+	}
+	if timeout <= margin {
+		return timeout / 2
+	}
+	return timeout - margin
+}
+
+// IsTimeout returns true if the error is caused by an expired deadline.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeoutFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Scrape
+		header string
+		want   time.Duration
+	}{
+		{"default", Scrape{}, "", 9500 * time.Millisecond},
+		{"configured", Scrape{Timeout: 5 * time.Second, Margin: time.Second}, "", 4 * time.Second},
+		{"header", Scrape{Timeout: 5 * time.Second}, "2.5", 2 * time.Second},
+		{"invalid header", Scrape{}, "soon", 9500 * time.Millisecond},
+		{"short", Scrape{}, "0.2", 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/_status/vars", nil)
+			if tt.header != "" {
+				r.Header.Set(ScrapeTimeoutHeader, tt.header)
+			}
+			assert.Equal(t, tt.want, tt.config.TimeoutFor(r))
+		})
+	}
+}
+
+func TestScrapeDeadline(t *testing.T) {
+	assert := assert.New(t)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	// The shared reads outlive the callers: the slow server is released before it is closed.
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("sql_conns 3\n"))
+	}))
+	defer fast.Close()
+
+	// A single target that does not respond in time: the caller gives up at its deadline.
+	config := &Config{URL: slow.URL}
+	pipeline := CreatePipeline(mustReader(t, config), CreateMetricsWriter(config))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := pipeline.Gather(ctx)
+	assert.True(IsTimeout(err))
+	assert.Less(time.Since(start), time.Second)
+
+	// With multiple targets, the partial results read within the upstream timeout are returned.
+	config = &Config{
+		Targets:  []Target{{URL: slow.URL}, {URL: fast.URL}},
+		Upstream: Upstream{Timeout: 200 * time.Millisecond},
+	}
+	pipeline = CreatePipeline(mustReader(t, config), CreateMetricsWriter(config))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	mfs, err := pipeline.Gather(ctx)
+	require.NoError(t, err)
+	assert.Len(mfs["sql_conns"].Metric, 1)
+	up := mfs[targetUpName].Metric
+	assert.Equal(0.0, up[0].GetGauge().GetValue())
+	assert.Equal(1.0, up[1].GetGauge().GetValue())
+
+	// A scrape timeout shorter than the upstream timeout bounds the shared read,
+	// the partial results are returned before the scrape deadline.
+	config.Upstream.Timeout = 10 * time.Second
+	pipeline = CreatePipeline(mustReader(t, config), CreateMetricsWriter(config))
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	mfs, err = pipeline.Gather(ctx)
+	require.NoError(t, err)
+	assert.Less(time.Since(start), 300*time.Millisecond)
+	assert.Len(mfs["sql_conns"].Metric, 1)
+	assert.Equal(0.0, mfs[targetUpName].Metric[0].GetGauge().GetValue())
+}
+
+func mustReader(t *testing.T, config *Config) *MetricsReader {
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	return reader
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SelfEndpoint is the path of the metrics about the exporter itself.
+const SelfEndpoint = "/_status/exporter"
+
+// SelfRegistry has the metrics about the exporter itself. They are served
+// on SelfEndpoint, separately from the CockroachDB metrics.
+var SelfRegistry = prometheus.NewRegistry()
+
+var (
+	selfMetrics = promauto.With(SelfRegistry)
+
+	upstreamScrapeDuration = selfMetrics.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "metrics_exporter_upstream_scrape_duration_seconds",
+			Help: "Duration of the scrapes of the upstream endpoints",
+		},
+		[]string{"instance"},
+	)
+	upstreamResponseBytes = selfMetrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_upstream_response_bytes_total",
+			Help: "Bytes received from the upstream endpoints",
+		},
+		[]string{"instance"},
+	)
+	upstreamScrapeErrors = selfMetrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_upstream_scrape_errors_total",
+			Help: "Failed scrapes of the upstream endpoints",
+		},
+		[]string{"instance"},
+	)
+	parseErrors = selfMetrics.NewCounter(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_parse_errors_total",
+			Help: "Upstream responses that could not be parsed",
+		},
+	)
+	familiesCount = selfMetrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_families",
+			Help: "Metric families read from upstream (in) and after the translation (out)",
+		},
+		[]string{"stage"},
+	)
+	seriesCount = selfMetrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_series",
+			Help: "Series read from upstream (in) and after the translation (out)",
+		},
+		[]string{"stage"},
+	)
+	translationSeconds = selfMetrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_translation_seconds_total",
+			Help: "Time spent translating each histogram family",
+		},
+		[]string{"family"},
+	)
+	sqlQueryDuration = selfMetrics.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "metrics_exporter_sql_query_duration_seconds",
+			Help: "Duration of the queries of the custom metrics collector",
+		},
+		[]string{"query"},
+	)
+	sqlQueryErrors = selfMetrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_sql_query_errors_total",
+			Help: "Failed queries of the custom metrics collector",
+		},
+		[]string{"query"},
+	)
+	configReloadSuccess = selfMetrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload succeeded",
+		},
+	)
+	configReloadTimestamp = selfMetrics.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		},
+	)
+	certificateExpiry = selfMetrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_certificate_expiry_timestamp_seconds",
+			Help: "Expiry of the certificates (the earliest one, for CA bundles), by file",
+		},
+		[]string{"file"},
+	)
+	unauthorizedRequests = selfMetrics.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metrics_exporter_unauthorized_requests_total",
+			Help: "Requests rejected by the authentication, by protected endpoint and reason",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	buildInfo = selfMetrics.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "metrics_exporter_build_info",
+			Help: "Build information of the exporter",
+		},
+		[]string{"version", "goversion"},
+	)
+)
+
+func init() {
+	SelfRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// SetBuildInfo sets the version reported by the build info metric.
+func SetBuildInfo(version string) {
+	buildInfo.Reset()
+	buildInfo.WithLabelValues(version, runtime.Version()).Set(1)
+}
+
+// observeFamilies records the number of families and series at the given stage.
+func observeFamilies(stage string, metricFamilies map[string]*dto.MetricFamily) {
+	series := 0
+	for _, mf := range metricFamilies {
+		series += len(mf.Metric)
+	}
+	familiesCount.WithLabelValues(stage).Set(float64(len(metricFamilies)))
+	seriesCount.WithLabelValues(stage).Set(float64(series))
+}
+
+// observeQuery records the duration and the outcome of a collector query.
+func observeQuery(query string, start time.Time, err error) {
+	sqlQueryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+	if err != nil {
+		sqlQueryErrors.WithLabelValues(query).Inc()
+	}
+}
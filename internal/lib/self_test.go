@@ -0,0 +1,64 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"net/url"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	assert := assert.New(t)
+	pipeline := newTestPipeline(t, input)
+	u, err := url.Parse(pipeline.Source.(*MetricsReader).Config.URL)
+	require.NoError(t, err)
+	bytesBefore := testutil.ToFloat64(upstreamResponseBytes.WithLabelValues(u.Host))
+
+	_, err = pipeline.Gather(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(float64(len(input)),
+		testutil.ToFloat64(upstreamResponseBytes.WithLabelValues(u.Host))-bytesBefore)
+	assert.Equal(1.0, testutil.ToFloat64(familiesCount.WithLabelValues("in")))
+	assert.Equal(1.0, testutil.ToFloat64(familiesCount.WithLabelValues("out")))
+	assert.Equal(1.0, testutil.ToFloat64(seriesCount.WithLabelValues("out")))
+	assert.Greater(
+		testutil.ToFloat64(translationSeconds.WithLabelValues("raft_process_logcommit_latency")), 0.0)
+
+	// The untranslated reads are recorded too, after the excluded histograms are dropped.
+	config := *pipeline.Writer().Config
+	config.Bucket.Exclude = "^raft_"
+	pipeline.SetWriter(CreateMetricsWriter(&config))
+	_, err = pipeline.GatherHDR(context.Background())
+	require.NoError(t, err)
+	assert.Equal(1.0, testutil.ToFloat64(familiesCount.WithLabelValues("in")))
+	assert.Equal(0.0, testutil.ToFloat64(familiesCount.WithLabelValues("out")))
+	assert.Equal(0.0, testutil.ToFloat64(seriesCount.WithLabelValues("out")))
+
+	SetBuildInfo("v1.2.3")
+	assert.Equal(1.0, testutil.ToFloat64(buildInfo.WithLabelValues("v1.2.3", runtime.Version())))
+
+	families, err := SelfRegistry.Gather()
+	require.NoError(t, err)
+	names := make(map[string]bool)
+	for _, mf := range families {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{
+		"metrics_exporter_upstream_scrape_duration_seconds",
+		"metrics_exporter_build_info",
+		"go_goroutines",
+	} {
+		assert.True(names[name], name)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	loginPath         = "/_admin/v1/login"
+	sessionCookieName = "session"
+)
+
+// sessionManager logs in to the CockroachDB HTTP API, and keeps the session cookie.
+// Sessions are valid on every node of the cluster, so the cookie is shared by all the targets.
+type sessionManager struct {
+	config Session
+
+	mu     sync.Mutex
+	cookie *http.Cookie
+}
+
+// sessionTransport adds the session cookie to the requests.
+// If a request without a body is rejected with a 401, it logs in again and retries
+// the request once.
+type sessionTransport struct {
+	session *sessionManager
+	base    http.RoundTripper
+}
+
+func newSessionManager(config Session) *sessionManager {
+	return &sessionManager{config: config}
+}
+
+// wrap returns a RoundTripper that authenticates the requests sent through base.
+func (s *sessionManager) wrap(base http.RoundTripper) http.RoundTripper {
+	return &sessionTransport{
+		session: s,
+		base:    base,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *sessionTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cookie, err := t.session.get(req.Context(), t.base, req.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(withCookie(req, cookie))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, err
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	log.Debugf("Session rejected by %s, logging in again", req.URL.Host)
+	cookie, err = t.session.get(req.Context(), t.base, req.URL, cookie)
+	if err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(withCookie(req, cookie))
+}
+
+// withCookie returns a copy of the request, with the session cookie.
+func withCookie(req *http.Request, cookie *http.Cookie) *http.Request {
+	res := req.Clone(req.Context())
+	res.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+	return res
+}
+
+// get returns the current session cookie. If there is no session, or the current
+// one is the rejected one, it logs in to the node at u.
+func (s *sessionManager) get(
+	ctx context.Context, base http.RoundTripper, u *url.URL, rejected *http.Cookie,
+) (*http.Cookie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookie != nil && s.cookie != rejected {
+		return s.cookie, nil
+	}
+	cookie, err := s.login(ctx, base, u)
+	if err != nil {
+		return nil, err
+	}
+	s.cookie = cookie
+	return cookie, nil
+}
+
+// login creates a new session, using the login API of the node at u.
+func (s *sessionManager) login(
+	ctx context.Context, base http.RoundTripper, u *url.URL,
+) (*http.Cookie, error) {
+	username, err := readCredential(s.config.Username, s.config.UsernameFile, s.config.UsernameEnv)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readCredential("", s.config.PasswordFile, s.config.PasswordEnv)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{
+		"username": username,
+		"password": password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	loginURL := url.URL{Scheme: u.Scheme, Host: u.Host, Path: loginPath}
+	req, err := http.NewRequestWithContext(
+		ctx, http.MethodPost, loginURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Login as %s failed: %s", username, resp.Status)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			log.Debugf("Logged in to %s as %s", u.Host, username)
+			return c, nil
+		}
+	}
+	return nil, errors.New("Login response has no session cookie")
+}
+
+// readCredential returns the value, if not empty, or the content of the file,
+// or the value of the environment variable.
+func readCredential(value string, file string, env string) (string, error) {
+	if value != "" || file != "" {
+		return readSecret(value, file)
+	}
+	if env == "" {
+		return "", nil
+	}
+	res, ok := os.LookupEnv(env)
+	if !ok {
+		return "", errors.New("Environment variable " + env + " is not set")
+	}
+	return strings.TrimSpace(res), nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAdminServer emulates the login API of a CockroachDB node.
+type fakeAdminServer struct {
+	mu      sync.Mutex
+	logins  int
+	session string
+}
+
+func (s *fakeAdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == loginPath {
+		var creds map[string]string
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&creds) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if creds["username"] != "monitor" || creds["password"] != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		s.logins++
+		s.session = "token-" + strconv.Itoa(s.logins)
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: s.session, HttpOnly: true})
+		return
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value != s.session {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, _ = w.Write([]byte("sql_conns 3\n"))
+}
+
+// expire invalidates the current session.
+func (s *fakeAdminServer) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = ""
+}
+
+func TestSessionLogin(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	admin := &fakeAdminServer{}
+	server := httptest.NewServer(admin)
+	defer server.Close()
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	t.Setenv("TEST_SESSION_USER", "monitor")
+	config := &Config{
+		URL: server.URL + "/_status/vars",
+		Session: Session{
+			UsernameEnv:  "TEST_SESSION_USER",
+			PasswordFile: passwordFile,
+		},
+		Upstream: Upstream{MaxRetries: -1},
+	}
+	require.NoError(t, config.Session.checkConfig())
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		mfs, err := reader.ReadMetrics(ctx)
+		require.NoError(t, err)
+		assert.Contains(mfs, "sql_conns")
+	}
+	assert.Equal(1, admin.logins)
+
+	// An expired session is refreshed transparently.
+	admin.expire()
+	mfs, err := reader.ReadMetrics(ctx)
+	require.NoError(t, err)
+	assert.Contains(mfs, "sql_conns")
+	assert.Equal(2, admin.logins)
+
+	// Login failures are reported.
+	require.NoError(t, os.WriteFile(passwordFile, []byte("wrong"), 0600))
+	admin.expire()
+	_, err = reader.ReadMetrics(ctx)
+	assert.EqualError(err, "Get \""+config.URL+"\": Login as monitor failed: 401 Unauthorized")
+}
+
+func TestSessionConfig(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(Session{PasswordFile: "password"}.checkConfig())
+	assert.Error(Session{Username: "monitor"}.checkConfig())
+	assert.NoError(Session{Username: "monitor", PasswordEnv: "PASSWORD"}.checkConfig())
+
+	_, err := readCredential("", "", "TEST_SESSION_UNSET")
+	assert.EqualError(err, "Environment variable TEST_SESSION_UNSET is not set")
+}
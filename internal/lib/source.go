@@ -0,0 +1,129 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Source provides the metrics to translate. The metric families returned
+// are owned by the caller, that can modify them.
+type Source interface {
+	ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error)
+}
+
+var (
+	_ Source = &MetricsReader{}
+	_ Source = &Replayer{}
+	_ Source = &FileSource{}
+	_ Source = &ReaderSource{}
+	_ Source = &StaticSource{}
+)
+
+// FileSource reads the metrics from a file, in the Prometheus text format.
+// The file is read every time, so that changes are picked up.
+type FileSource struct {
+	path string
+}
+
+// NewFileSource instantiates a FileSource
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+// ReadMetrics implements Source.
+func (s *FileSource) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	return parseFile(s.path)
+}
+
+// parseFile parses a file in the Prometheus text format.
+func parseFile(path string) (map[string]*dto.MetricFamily, error) {
+	r, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(r)
+}
+
+// ReaderSource reads the metrics from a reader (e.g. stdin), in the Prometheus text format.
+// The reader is consumed on the first call; the same metrics are returned by the following ones.
+type ReaderSource struct {
+	r    io.Reader
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// NewReaderSource instantiates a ReaderSource
+func NewReaderSource(r io.Reader) *ReaderSource {
+	return &ReaderSource{r: r}
+}
+
+// NewStdinSource instantiates a ReaderSource that reads from stdin
+func NewStdinSource() *ReaderSource {
+	return NewReaderSource(os.Stdin)
+}
+
+// ReadMetrics implements Source.
+func (s *ReaderSource) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	s.once.Do(func() {
+		s.data, s.err = ioutil.ReadAll(s.r)
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(bytes.NewReader(s.data))
+}
+
+// StaticSource returns copies of in-memory metric families. It is a stand-in
+// for the upstream endpoints in tests.
+type StaticSource struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewStaticSource instantiates a StaticSource
+func NewStaticSource(metricFamilies map[string]*dto.MetricFamily) (*StaticSource, error) {
+	s := &StaticSource{}
+	if err := s.Set(metricFamilies); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Set replaces the metric families returned by the source.
+func (s *StaticSource) Set(metricFamilies map[string]*dto.MetricFamily) error {
+	// The families are stored in the text format, so that every call returns a deep copy.
+	var buf bytes.Buffer
+	if err := WriteText(&buf, metricFamilies); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = buf.Bytes()
+	return nil
+}
+
+// ReadMetrics implements Source.
+func (s *StaticSource) ReadMetrics(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	data := s.data
+	s.mu.Unlock()
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(bytes.NewReader(data))
+}
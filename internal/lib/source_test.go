@@ -0,0 +1,79 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSources(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input.txt")
+	require.NoError(t, os.WriteFile(path, []byte(input), 0644))
+
+	file, err := NewFileSource(path).ReadMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(file, 1)
+
+	reader := NewReaderSource(strings.NewReader(input))
+	for i := 0; i < 2; i++ {
+		mfs, err := reader.ReadMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(file, mfs)
+	}
+
+	static, err := NewStaticSource(file)
+	require.NoError(t, err)
+	first, err := static.ReadMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(file, first)
+	// Every call returns a copy.
+	for name := range first {
+		first[name].Metric = nil
+	}
+	second, err := static.ReadMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(file, second)
+
+	_, err = NewFileSource(filepath.Join(dir, "missing.txt")).ReadMetrics(ctx)
+	assert.Error(err)
+}
+
+func TestPipelineWithSource(t *testing.T) {
+	ctx := context.Background()
+	source := NewReaderSource(strings.NewReader(input))
+	config := &Config{Bucket: BucketConfig{Startns: 100, Bins: 10}}
+	pipeline := CreatePipeline(source, CreateMetricsWriter(config))
+	mfs, err := pipeline.Gather(ctx)
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		assert.Len(t, mf.Metric[0].GetHistogram().GetBucket(), 33)
+	}
+}
+
+func TestReplayGlob(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	for _, name := range []string{"b.prom", "a.prom", "c.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("test 1\n"), 0644))
+	}
+	replayer, err := NewReplayer(filepath.Join(dir, "*.prom"))
+	require.NoError(t, err)
+	assert.Equal([]string{filepath.Join(dir, "a.prom"), filepath.Join(dir, "b.prom")}, replayer.files)
+
+	_, err = NewReplayer(filepath.Join(dir, "*.json"))
+	assert.Error(err)
+}
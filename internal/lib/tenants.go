@@ -0,0 +1,110 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TenantHeader selects the virtual cluster that serves an HTTP request.
+const TenantHeader = "X-Cockroach-Tenant"
+
+const virtualClustersQuery = `
+SELECT
+  name
+FROM
+  [SHOW VIRTUAL CLUSTERS]
+WHERE
+  data_state = 'ready' AND service_mode = 'shared'
+ORDER BY
+  name;`
+
+// TenantLister lists the virtual clusters.
+type TenantLister interface {
+	ListTenants(ctx context.Context) ([]string, error)
+}
+
+// TenantDiscoverer periodically lists the virtual clusters, and
+// updates the tenants scraped by the MetricsReader.
+type TenantDiscoverer struct {
+	interval time.Duration
+	reader   *MetricsReader
+	lister   TenantLister
+}
+
+// NewTenantDiscoverer instantiates a TenantDiscoverer
+func NewTenantDiscoverer(
+	config Tenants, reader *MetricsReader, lister TenantLister,
+) *TenantDiscoverer {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval
+	}
+	return &TenantDiscoverer{
+		interval: interval,
+		reader:   reader,
+		lister:   lister,
+	}
+}
+
+// Run refreshes the tenants until the context is done.
+func (d *TenantDiscoverer) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		if err := d.Discover(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("Error discovering virtual clusters: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover lists the virtual clusters and updates the tenants. If the virtual
+// clusters cannot be listed, the current tenants are preserved.
+func (d *TenantDiscoverer) Discover(ctx context.Context) error {
+	tenants, err := d.lister.ListTenants(ctx)
+	if err != nil {
+		return err
+	}
+	if len(tenants) == 0 {
+		return errors.New("No virtual clusters found")
+	}
+	log.Debugf("Discovered %d virtual clusters", len(tenants))
+	d.reader.SetTenants(tenants)
+	return nil
+}
+
+// ListTenants returns the virtual clusters that are ready and run in shared service mode.
+func (c *Collector) ListTenants(ctx context.Context) ([]string, error) {
+	conn, err := c.getConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+	rows, err := conn.Query(ctx, virtualClustersQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		res = append(res, name)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tenantList struct {
+	tenants []string
+	err     error
+}
+
+func (l *tenantList) ListTenants(ctx context.Context) ([]string, error) {
+	return l.tenants, l.err
+}
+
+func TestTenants(t *testing.T) {
+	assert := assert.New(t)
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(TenantHeader)
+		if tenant == "" {
+			tenant = "system"
+		}
+		fmt.Fprintf(w, "# TYPE sql_conns gauge\nsql_conns %d\n", len(tenant))
+	}))
+	defer node.Close()
+	u, err := url.Parse(node.URL)
+	require.NoError(t, err)
+
+	config := &Config{
+		URL:     node.URL,
+		Bucket:  BucketConfig{Startns: 100, Bins: 10},
+		Tenants: Tenants{Names: []string{"system"}},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	_, err = expfmt.MetricFamilyToText(&buf, mfs["sql_conns"])
+	require.NoError(t, err)
+	assert.Equal(fmt.Sprintf(`# TYPE sql_conns gauge
+sql_conns{instance="%[1]s",tenant="system"} 6
+`, u.Host), buf.String())
+
+	// The discovered virtual clusters replace the configured ones.
+	lister := &tenantList{tenants: []string{"app", "system"}}
+	discoverer := NewTenantDiscoverer(config.Tenants, reader, lister)
+	require.NoError(t, discoverer.Discover(context.Background()))
+	mfs, err = reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	buf.Reset()
+	_, err = expfmt.MetricFamilyToText(&buf, mfs["sql_conns"])
+	require.NoError(t, err)
+	assert.Equal(fmt.Sprintf(`# TYPE sql_conns gauge
+sql_conns{instance="%[1]s",tenant="app"} 3
+sql_conns{instance="%[1]s",tenant="system"} 6
+`, u.Host), buf.String())
+
+	// The tenants are preserved if they cannot be listed.
+	lister.err = errors.New("unavailable")
+	assert.Error(discoverer.Discover(context.Background()))
+	lister.err, lister.tenants = nil, nil
+	assert.Error(discoverer.Discover(context.Background()))
+	assert.Len(reader.targets, 2)
+}
+
+func TestTenantsConfig(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(Tenants{Discover: true}.checkConfig(Config{}))
+	assert.NoError(Tenants{Discover: true}.checkConfig(Config{Custom: Custom{Endpoint: "/_status/custom"}}))
+	assert.Error(Tenants{Names: []string{""}}.checkConfig(Config{}))
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues the certificates used by the TLS tests.
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key, _, _ = ca.issue("ca", time.Hour, nil)
+	return ca
+}
+
+// issue creates a certificate, signed by the CA (self-signed if the CA is not created yet),
+// and writes it to the test directory. It returns the certificate and key files.
+// The names that are IP addresses are added as IP SANs; without any, 127.0.0.1 is added.
+func (ca *testCA) issue(
+	name string, validity time.Duration, names []string,
+) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	t := ca.t
+	var dnsNames []string
+	var ips []net.IP
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			dnsNames = append(dnsNames, n)
+		}
+	}
+	if len(ips) == 0 {
+		ips = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca.cert == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	if ca.cert == nil {
+		ca.file = certFile
+	}
+	return cert, key, certFile, keyFile
+}
+
+// newTLSServer starts a server with the given TLS configuration.
+func newTLSServer(t *testing.T, config *Config) *httptest.Server {
+	tlsConfig, err := config.GetTLSServerContext()
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.TLS = tlsConfig
+	if tlsConfig.GetConfigForClient == nil {
+		// StartTLS adds the httptest certificate, used when the client sends no SNI.
+		base := tlsConfig.Clone()
+		server.TLS.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return base, nil
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// tlsGet connects to the server with the client certificate (if any).
+func tlsGet(t *testing.T, ca *testCA, url string, client *TLSConfig) error {
+	if client == nil {
+		client = &TLSConfig{Ca: ca.file}
+	}
+	transport, err := client.GetTransport()
+	require.NoError(t, err)
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func TestServerTLS(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCA(t)
+	_, _, serverCert, serverKey := ca.issue("exporter", time.Hour, []string{"localhost"})
+	_, _, promCert, promKey := ca.issue("prometheus", time.Hour, nil)
+	_, _, otherCert, otherKey := ca.issue("other", time.Hour, []string{"other.local"})
+	prometheus := &TLSConfig{Ca: ca.file, Certificate: promCert, PrivateKey: promKey}
+	other := &TLSConfig{Ca: ca.file, Certificate: otherCert, PrivateKey: otherKey}
+
+	// The top level tls section is used without client authentication.
+	server := newTLSServer(t, &Config{
+		TLS: TLSConfig{Ca: ca.file, Certificate: serverCert, PrivateKey: serverKey},
+	})
+	assert.NoError(tlsGet(t, ca, server.URL, nil))
+
+	server = newTLSServer(t, &Config{
+		TLS: TLSConfig{Ca: ca.file, Certificate: promCert, PrivateKey: promKey},
+		Server: Server{TLS: &ServerTLS{
+			Ca:             ca.file,
+			Certificate:    serverCert,
+			PrivateKey:     serverKey,
+			ClientAuth:     ClientAuthRequireAndVerify,
+			AllowedClients: []string{"prometheus", "other.local"},
+		}},
+	})
+	assert.Error(tlsGet(t, ca, server.URL, nil))
+	assert.NoError(tlsGet(t, ca, server.URL, prometheus))
+	assert.NoError(tlsGet(t, ca, server.URL, other))
+
+	server = newTLSServer(t, &Config{
+		Server: Server{TLS: &ServerTLS{
+			Ca:             ca.file,
+			Certificate:    serverCert,
+			PrivateKey:     serverKey,
+			ClientAuth:     ClientAuthRequireAndVerify,
+			AllowedClients: []string{"prometheus"},
+		}},
+	})
+	assert.NoError(tlsGet(t, ca, server.URL, prometheus))
+	assert.Error(tlsGet(t, ca, server.URL, other))
+
+	// A client certificate signed by another CA is rejected, if sent.
+	server = newTLSServer(t, &Config{
+		Server: Server{TLS: &ServerTLS{
+			Ca:          ca.file,
+			Certificate: serverCert,
+			PrivateKey:  serverKey,
+			ClientAuth:  ClientAuthRequest,
+		}},
+	})
+	assert.NoError(tlsGet(t, ca, server.URL, nil))
+	assert.NoError(tlsGet(t, ca, server.URL, prometheus))
+	otherCA := newTestCA(t)
+	_, _, untrustedCert, untrustedKey := otherCA.issue("prometheus", time.Hour, nil)
+	assert.Error(tlsGet(t, ca, server.URL,
+		&TLSConfig{Ca: ca.file, Certificate: untrustedCert, PrivateKey: untrustedKey}))
+
+	// The server certificate must match the IP address dialed.
+	_, _, wrongCert, wrongKey := ca.issue("wrong", time.Hour, []string{"10.0.0.1"})
+	server = newTLSServer(t, &Config{
+		Server: Server{TLS: &ServerTLS{Certificate: wrongCert, PrivateKey: wrongKey}},
+	})
+	err := tlsGet(t, ca, server.URL, nil)
+	require.Error(t, err)
+	assert.Contains(err.Error(), "certificate is valid for 10.0.0.1, not 127.0.0.1")
+
+	// The host of the TLS configuration is verified instead of the address dialed.
+	_, _, namedCert, namedKey := ca.issue("named", time.Hour, []string{"cockroach.internal", "10.0.0.1"})
+	server = newTLSServer(t, &Config{
+		Server: Server{TLS: &ServerTLS{Certificate: namedCert, PrivateKey: namedKey}},
+	})
+	assert.Error(tlsGet(t, ca, server.URL, nil))
+	assert.NoError(tlsGet(t, ca, server.URL, &TLSConfig{Ca: ca.file, Host: "cockroach.internal"}))
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	assert := assert.New(t)
+	assert.EqualError((&ServerTLS{}).checkConfig(), `2 problems found:
+  certificate: The server certificate is required
+  privatekey: The server private key is required`)
+	s := ServerTLS{Certificate: "server.crt", PrivateKey: "server.key"}
+	assert.NoError(s.checkConfig())
+	s.ClientAuth = "always"
+	assert.EqualError(s.checkConfig(), "clientauth: Invalid client auth mode: always")
+	s.ClientAuth = ClientAuthRequireAndVerify
+	assert.EqualError(s.checkConfig(), "ca: A CA is required to verify the client certificates")
+	s.Ca = "ca.crt"
+	assert.NoError(s.checkConfig())
+	s.ClientAuth, s.AllowedClients = ClientAuthRequest, []string{"prometheus"}
+	assert.EqualError(s.checkConfig(),
+		"allowedclients: The allowed clients require the require-and-verify client auth mode")
+
+	config := &Config{TLS: TLSConfig{Ca: "ca.crt"}}
+	assert.Equal(TLSConfig{Ca: "ca.crt"}, config.UpstreamTLS())
+	config.Upstream.TLS = &TLSConfig{Ca: "upstream.crt"}
+	assert.Equal(TLSConfig{Ca: "upstream.crt"}, config.UpstreamTLS())
+	assert.True(config.IsSecure())
+	assert.False((&Config{Upstream: Upstream{TLS: &TLSConfig{Ca: "ca.crt"}}}).IsSecure())
+}
+
+// touch moves the modification time of the files forward, so that the changes are
+// detected even if the file system has a coarse time resolution.
+func touch(t *testing.T, files ...string) {
+	for _, file := range files {
+		future := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(file, future, future))
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	assert := assert.New(t)
+	defer func(interval time.Duration) { certCheckInterval = interval }(certCheckInterval)
+	certCheckInterval = 0
+	ca := newTestCA(t)
+	first, _, serverCert, serverKey := ca.issue("exporter", time.Hour, nil)
+	client, _, clientCert, clientKey := ca.issue("prometheus", time.Hour, nil)
+	config := &Config{
+		Server: Server{TLS: &ServerTLS{
+			Ca:          ca.file,
+			Certificate: serverCert,
+			PrivateKey:  serverKey,
+			ClientAuth:  ClientAuthRequireAndVerify,
+		}},
+	}
+	var mu sync.Mutex
+	var served, presented *big.Int
+	tlsConfig, err := config.GetTLSServerContext()
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		presented = r.TLS.PeerCertificates[0].SerialNumber
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+	assert.Equal(float64(first.NotAfter.Unix()),
+		testutil.ToFloat64(certificateExpiry.WithLabelValues(serverCert)))
+
+	upstream := &TLSConfig{Ca: ca.file, Certificate: clientCert, PrivateKey: clientKey}
+	transport, err := upstream.GetTransport()
+	require.NoError(t, err)
+	transport.DisableKeepAlives = true
+	get := func() error {
+		resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		served = resp.TLS.PeerCertificates[0].SerialNumber
+		return resp.Body.Close()
+	}
+	require.NoError(t, get())
+	assert.Equal(first.SerialNumber, served)
+	assert.Equal(client.SerialNumber, presented)
+
+	// The server and client certificates are rotated.
+	second, _, _, _ := ca.issue("exporter", 2*time.Hour, nil)
+	client, _, _, _ = ca.issue("prometheus", 2*time.Hour, nil)
+	touch(t, serverCert, serverKey, clientCert, clientKey)
+	require.NoError(t, get())
+	assert.Equal(second.SerialNumber, served)
+	assert.Equal(client.SerialNumber, presented)
+	assert.Equal(float64(second.NotAfter.Unix()),
+		testutil.ToFloat64(certificateExpiry.WithLabelValues(serverCert)))
+
+	// A partially written key pair is not loaded.
+	require.NoError(t, os.WriteFile(serverKey, nil, 0600))
+	touch(t, serverKey)
+	require.NoError(t, get())
+	assert.Equal(second.SerialNumber, served)
+
+	// The CA is rotated: the certificates signed by the new CA are accepted.
+	newCA := newTestCA(t)
+	_, _, newCert, newKey := newCA.issue("exporter", time.Hour, nil)
+	for from, to := range map[string]string{
+		newCA.file: ca.file, newCert: serverCert, newKey: serverKey,
+	} {
+		data, err := os.ReadFile(from)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(to, data, 0600))
+	}
+	touch(t, ca.file, serverCert, serverKey)
+	// The client certificate is signed by the old CA.
+	assert.Error(get())
+	_, _, _, _ = newCA.issue("prometheus", time.Hour, nil)
+	upstream = &TLSConfig{
+		Ca:          ca.file,
+		Certificate: filepath.Join(newCA.dir, "prometheus.crt"),
+		PrivateKey:  filepath.Join(newCA.dir, "prometheus.key"),
+	}
+	transport, err = upstream.GetTransport()
+	require.NoError(t, err)
+	assert.NoError(get())
+}
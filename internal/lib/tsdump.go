@@ -0,0 +1,501 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Tsdump formats.
+const (
+	TsdumpCSV = "csv"
+	TsdumpRaw = "raw"
+)
+
+// tsdumpPrefixes maps the prefixes of the internal time series names
+// to the label that identifies the source, as in the /_status/vars endpoint.
+var tsdumpPrefixes = []struct {
+	prefix string
+	label  string
+}{
+	{"cr.node.", "node_id"},
+	{"cr.store.", "store"},
+}
+
+// tsdumpQuantiles maps the suffixes of the histogram time series to the quantiles.
+var tsdumpQuantiles = map[string]string{
+	"max": "1",
+}
+
+// The encoding of the time series keys and values of the raw format
+// (pkg/keys, pkg/util/encoding and pkg/roachpb in CockroachDB).
+var tsdumpKeyPrefix = []byte("\x04tsd")
+
+const (
+	keyBytesMarker = 0x12
+	keyIntZero     = 136
+	keyIntSmall    = 109
+	keyIntMax      = 253
+	// tsdumpResolution10s is the resolution of the samples; the rollups
+	// (30m resolution) are skipped, as they would duplicate the samples.
+	tsdumpResolution10s = 1
+	// timeseriesTag is the tag of the roachpb.Value that holds an InternalTimeSeriesData,
+	// after the 4 bytes checksum.
+	timeseriesTag   = 100
+	valueHeaderSize = 5
+)
+
+// tsdumpSample receives the samples of the time series, in the order of the tsdump.
+type tsdumpSample func(name string, source string, timestampMs int64, value float64) error
+
+// ConvertTsdump reads the time series written by cockroach debug tsdump, and writes
+// them in the OpenMetrics text format, with the names used by the /_status/vars endpoint.
+//
+// Each line of the CSV format has the name, the timestamp (RFC 3339), the source
+// (node or store id) and the value. The raw format is the stream of gob encoded
+// roachpb.KeyValue of the time series, as stored by CockroachDB; only the 10s
+// resolution is converted.
+//
+// Histograms are stored in the time series as quantiles (name-p50, name-p99, name-max, ...),
+// which are written as the name series with a quantile label; name-count and name-avg
+// are written as the name_count and name_avg series. The buckets are not stored, so
+// the histograms cannot be converted.
+//
+// The dump is converted one metric family at a time, so that only the samples of
+// a family are held in memory: as in the output of cockroach debug tsdump, the time
+// series of a family must be contiguous.
+func ConvertTsdump(in io.Reader, format string, out io.Writer) error {
+	w := &openMetricsWriter{out: out, written: make(map[string]bool)}
+	var err error
+	switch format {
+	case TsdumpCSV:
+		err = readTsdumpCSV(in, w.add)
+	case TsdumpRaw:
+		err = readTsdumpRaw(in, w.add)
+	default:
+		return errors.New("Invalid tsdump format: " + format)
+	}
+	if err != nil {
+		return err
+	}
+	return w.close()
+}
+
+func readTsdumpCSV(in io.Reader, sample tsdumpSample) error {
+	r := csv.NewReader(in)
+	r.FieldsPerRecord = 4
+	r.ReuseRecord = true
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ts, err := time.Parse(time.RFC3339Nano, record[1])
+		if err != nil {
+			if line == 1 {
+				// Skipping the header.
+				continue
+			}
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := strconv.ParseFloat(record[3], 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := sample(record[0], record[2], ts.UnixNano()/int64(time.Millisecond), value); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+}
+
+// rawKeyValue decodes the gob encoded roachpb.KeyValue; the other fields
+// (e.g. the timestamp of the value) are ignored.
+type rawKeyValue struct {
+	Key   []byte
+	Value struct {
+		RawBytes []byte
+	}
+}
+
+func readTsdumpRaw(in io.Reader, sample tsdumpSample) error {
+	dec := gob.NewDecoder(in)
+	for record := 1; ; record++ {
+		var kv rawKeyValue
+		if err := dec.Decode(&kv); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("record %d: %w", record, err)
+		}
+		if err := decodeTsdumpRecord(kv, sample); err != nil {
+			return fmt.Errorf("record %d: %w", record, err)
+		}
+	}
+}
+
+// decodeTsdumpRecord decodes the key (/System/tsd/name/resolution/slab/source)
+// and the InternalTimeSeriesData value of a time series slab.
+func decodeTsdumpRecord(kv rawKeyValue, sample tsdumpSample) error {
+	if !bytes.HasPrefix(kv.Key, tsdumpKeyPrefix) {
+		return fmt.Errorf("Invalid time series key %q", kv.Key)
+	}
+	name, key, err := decodeKeyBytes(kv.Key[len(tsdumpKeyPrefix):])
+	if err != nil {
+		return err
+	}
+	resolution, key, err := decodeKeyUvarint(key)
+	if err != nil {
+		return err
+	}
+	if resolution != tsdumpResolution10s {
+		return nil
+	}
+	if _, key, err = decodeKeyUvarint(key); err != nil {
+		return err
+	}
+	source := string(key)
+	raw := kv.Value.RawBytes
+	if len(raw) < valueHeaderSize || raw[valueHeaderSize-1] != timeseriesTag {
+		return fmt.Errorf("%s: Invalid time series value", name)
+	}
+	data, err := decodeTimeSeriesData(raw[valueHeaderSize:])
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	for _, s := range data.samples() {
+		ts := data.start + int64(s.offset)*data.duration
+		if err := sample(name, source, ts/int64(time.Millisecond), s.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeKeyBytes decodes the escaped bytes of a key, terminated by 0x00 0x01.
+func decodeKeyBytes(b []byte) (string, []byte, error) {
+	if len(b) == 0 || b[0] != keyBytesMarker {
+		return "", nil, errors.New("Invalid time series name")
+	}
+	b = b[1:]
+	var res []byte
+	for {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 || i+1 >= len(b) {
+			return "", nil, errors.New("Unterminated time series name")
+		}
+		res = append(res, b[:i]...)
+		switch b[i+1] {
+		case 0x01:
+			return string(res), b[i+2:], nil
+		case 0xff:
+			res = append(res, 0)
+			b = b[i+2:]
+		default:
+			return "", nil, errors.New("Invalid time series name")
+		}
+	}
+}
+
+// decodeKeyUvarint decodes the non negative varints of a key: the small values are
+// stored in the first byte, the others in the following 1 to 8 bytes, big endian.
+func decodeKeyUvarint(b []byte) (int64, []byte, error) {
+	if len(b) == 0 {
+		return 0, nil, errors.New("Truncated time series key")
+	}
+	c := int(b[0])
+	switch {
+	case c >= keyIntZero && c <= keyIntZero+keyIntSmall:
+		return int64(c - keyIntZero), b[1:], nil
+	case c > keyIntZero+keyIntSmall && c <= keyIntMax:
+		n := c - (keyIntMax - 8)
+		if len(b) < 1+n {
+			return 0, nil, errors.New("Truncated time series key")
+		}
+		var v uint64
+		for _, x := range b[1 : 1+n] {
+			v = v<<8 | uint64(x)
+		}
+		return int64(v), b[1+n:], nil
+	}
+	return 0, nil, errors.New("Invalid integer in time series key")
+}
+
+// timeSeriesData is the decoded roachpb.InternalTimeSeriesData. The samples are either
+// in the columns (offset and last), or in the rows of the older versions.
+type timeSeriesData struct {
+	start, duration int64
+	offsets         []int32
+	last            []float64
+	rows            []timeSeriesSample
+}
+
+type timeSeriesSample struct {
+	offset int32
+	value  float64
+}
+
+func (d *timeSeriesData) samples() []timeSeriesSample {
+	if len(d.offsets) == 0 {
+		return d.rows
+	}
+	res := make([]timeSeriesSample, len(d.offsets))
+	for i, offset := range d.offsets {
+		res[i] = timeSeriesSample{offset: offset, value: d.last[i]}
+	}
+	return res
+}
+
+// decodeTimeSeriesData decodes the protobuf encoding of the InternalTimeSeriesData:
+// start_timestamp_nanos = 1, sample_duration_nanos = 2, samples = 3 (the rows),
+// offset = 4 and last = 5 (the columns). The rollup columns are ignored.
+func decodeTimeSeriesData(b []byte) (*timeSeriesData, error) {
+	d := &timeSeriesData{}
+	err := decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			d.start = int64(v)
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			d.duration = int64(v)
+			return n, nil
+		case num == 3 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			row, err := decodeTimeSeriesSample(v)
+			d.rows = append(d.rows, row)
+			return n, err
+		case num == 4:
+			return consumeRepeated(b, typ, protowire.VarintType, func(b []byte) int {
+				v, n := protowire.ConsumeVarint(b)
+				d.offsets = append(d.offsets, int32(v))
+				return n
+			})
+		case num == 5:
+			return consumeRepeated(b, typ, protowire.Fixed64Type, func(b []byte) int {
+				v, n := protowire.ConsumeFixed64(b)
+				d.last = append(d.last, math.Float64frombits(v))
+				return n
+			})
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(d.last) != len(d.offsets) {
+		return nil, errors.New("Invalid time series columns")
+	}
+	return d, nil
+}
+
+// decodeTimeSeriesSample decodes an InternalTimeSeriesSample: offset = 1,
+// count = 6 and sum = 7. The value is the average of the sample.
+func decodeTimeSeriesSample(b []byte) (timeSeriesSample, error) {
+	var s timeSeriesSample
+	count, sum := uint64(1), 0.0
+	err := decodeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			s.offset = int32(v)
+			return n, nil
+		case num == 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			count = v
+			return n, nil
+		case num == 7 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			sum = math.Float64frombits(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	if count > 0 {
+		s.value = sum / float64(count)
+	}
+	return s, err
+}
+
+// decodeMessage calls field for each field of the message, which returns the length
+// of the value it consumed.
+func decodeMessage(
+	b []byte, field func(num protowire.Number, typ protowire.Type, b []byte) (int, error),
+) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := field(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// consumeRepeated consumes a packed or unpacked element of a repeated field.
+func consumeRepeated(
+	b []byte, typ protowire.Type, elem protowire.Type, consume func([]byte) int,
+) (int, error) {
+	switch typ {
+	case elem:
+		return consume(b), nil
+	case protowire.BytesType:
+		packed, n := protowire.ConsumeBytes(b)
+		for len(packed) > 0 {
+			m := consume(packed)
+			if m < 0 {
+				return m, nil
+			}
+			packed = packed[m:]
+		}
+		return n, nil
+	}
+	return 0, errors.New("Invalid time series column")
+}
+
+// tsdumpName returns the Prometheus name and labels of a time series.
+func tsdumpName(name string, source string) (string, []*dto.LabelPair) {
+	var labels []*dto.LabelPair
+	for _, p := range tsdumpPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			name = strings.TrimPrefix(name, p.prefix)
+			if source != "" {
+				labels = append(labels, &dto.LabelPair{
+					Name:  proto.String(p.label),
+					Value: proto.String(source),
+				})
+			}
+			break
+		}
+	}
+	if i := strings.LastIndex(name, "-"); i > 0 {
+		suffix := name[i+1:]
+		quantile, ok := tsdumpQuantiles[suffix]
+		if !ok && strings.HasPrefix(suffix, "p") {
+			if p, err := strconv.ParseFloat(suffix[1:], 64); err == nil {
+				quantile, ok = strconv.FormatFloat(p/100, 'g', 12, 64), true
+			}
+		}
+		switch {
+		case ok:
+			name = name[:i]
+			labels = append(labels, &dto.LabelPair{
+				Name:  proto.String("quantile"),
+				Value: proto.String(quantile),
+			})
+		case suffix == "count" || suffix == "avg":
+			name = name[:i] + "_" + suffix
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return sanitizeName(name), labels
+}
+
+// sanitizeName replaces the characters that are not valid in a Prometheus name with underscores.
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// openMetricsWriter writes the samples in the OpenMetrics text format, one metric
+// family at a time, with the samples of each series in chronological order.
+type openMetricsWriter struct {
+	out     io.Writer
+	current *dto.MetricFamily
+	written map[string]bool
+}
+
+func (w *openMetricsWriter) add(name string, source string, timestampMs int64, value float64) error {
+	name, labels := tsdumpName(name, source)
+	if w.current != nil && w.current.GetName() != name {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if w.current == nil {
+		if w.written[name] {
+			return fmt.Errorf("The time series of %s are not contiguous", name)
+		}
+		w.current = &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: dto.MetricType_UNTYPED.Enum(),
+		}
+	}
+	w.current.Metric = append(w.current.Metric, &dto.Metric{
+		Label:       labels,
+		Untyped:     &dto.Untyped{Value: proto.Float64(value)},
+		TimestampMs: proto.Int64(timestampMs),
+	})
+	return nil
+}
+
+func (w *openMetricsWriter) flush() error {
+	mf := w.current
+	w.current = nil
+	w.written[mf.GetName()] = true
+	sort.SliceStable(mf.Metric, func(i, j int) bool {
+		a, b := labelsKey(mf.Metric[i].Label), labelsKey(mf.Metric[j].Label)
+		if a != b {
+			return a < b
+		}
+		return mf.Metric[i].GetTimestampMs() < mf.Metric[j].GetTimestampMs()
+	})
+	_, err := expfmt.MetricFamilyToOpenMetrics(w.out, mf)
+	return err
+}
+
+func (w *openMetricsWriter) close() error {
+	if w.current != nil {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	_, err := expfmt.FinalizeOpenMetrics(w.out)
+	return err
+}
+
+func labelsKey(labels []*dto.LabelPair) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.GetName() + "=" + l.GetValue() + ",")
+	}
+	return b.String()
+}
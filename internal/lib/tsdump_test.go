@@ -0,0 +1,152 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const tsdumpInput = `cr.node.sql.conns,2022-11-08T14:00:10Z,1,3
+cr.node.sql.conns,2022-11-08T14:00:00Z,1,2
+cr.node.sql.conns,2022-11-08T14:00:00Z,2,5
+cr.store.capacity.available,2022-11-08T14:00:00Z,1,1.5e+09
+cr.node.sql.service.latency-p99.9,2022-11-08T14:00:00Z,1,2.5e+06
+cr.node.sql.service.latency-max,2022-11-08T14:00:00Z,1,4e+06
+cr.node.sql.service.latency-count,2022-11-08T14:00:00Z,1,120
+cr.node.sys.cpu.combined.percent-normalized,2022-11-08T14:00:00Z,1,0.25
+`
+
+func TestTsdump(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, ConvertTsdump(strings.NewReader(tsdumpInput), TsdumpCSV, &buf))
+	assert.Equal(t, tsdumpOutput, buf.String())
+}
+
+// The families are written in the order of the tsdump, the series sorted by labels and time.
+const tsdumpOutput = `# TYPE sql_conns unknown
+sql_conns{node_id="1"} 2.0 1.667916e+09
+sql_conns{node_id="1"} 3.0 1.66791601e+09
+sql_conns{node_id="2"} 5.0 1.667916e+09
+# TYPE capacity_available unknown
+capacity_available{store="1"} 1.5e+09 1.667916e+09
+# TYPE sql_service_latency unknown
+sql_service_latency{node_id="1",quantile="0.999"} 2.5e+06 1.667916e+09
+sql_service_latency{node_id="1",quantile="1"} 4e+06 1.667916e+09
+# TYPE sql_service_latency_count unknown
+sql_service_latency_count{node_id="1"} 120.0 1.667916e+09
+# TYPE sys_cpu_combined_percent_normalized unknown
+sys_cpu_combined_percent_normalized{node_id="1"} 0.25 1.667916e+09
+# EOF
+`
+
+// tsdumpKeyValue mirrors the roachpb.KeyValue written by cockroach debug tsdump --format=raw.
+type tsdumpKeyValue struct {
+	Key   []byte
+	Value struct {
+		RawBytes  []byte
+		Timestamp struct{ WallTime int64 }
+	}
+}
+
+// tsdumpRecord encodes a time series slab, as stored by CockroachDB.
+func tsdumpRecord(name string, resolution uint64, source string, start time.Time, columns bool, values ...float64) tsdumpKeyValue {
+	var kv tsdumpKeyValue
+	key := append([]byte(nil), tsdumpKeyPrefix...)
+	key = append(key, keyBytesMarker)
+	key = append(key, name...)
+	key = append(key, 0x00, 0x01, byte(keyIntZero+resolution))
+	// The slab timestamp does not fit in the first byte.
+	slab := make([]byte, 8)
+	binary.BigEndian.PutUint64(slab, uint64(start.UnixNano()))
+	key = append(append(key, keyIntMax), slab...)
+	kv.Key = append(key, source...)
+
+	data := protowire.AppendTag(nil, 1, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(start.UnixNano()))
+	data = protowire.AppendTag(data, 2, protowire.VarintType)
+	data = protowire.AppendVarint(data, uint64(10*time.Second))
+	if columns {
+		var offsets, last []byte
+		for i, value := range values {
+			offsets = protowire.AppendVarint(offsets, uint64(i))
+			last = protowire.AppendFixed64(last, math.Float64bits(value))
+		}
+		data = protowire.AppendTag(data, 4, protowire.BytesType)
+		data = protowire.AppendBytes(data, offsets)
+		data = protowire.AppendTag(data, 5, protowire.BytesType)
+		data = protowire.AppendBytes(data, last)
+	} else {
+		for i, value := range values {
+			row := protowire.AppendTag(nil, 1, protowire.VarintType)
+			row = protowire.AppendVarint(row, uint64(i))
+			row = protowire.AppendTag(row, 6, protowire.VarintType)
+			row = protowire.AppendVarint(row, 2)
+			row = protowire.AppendTag(row, 7, protowire.Fixed64Type)
+			row = protowire.AppendFixed64(row, math.Float64bits(2*value))
+			data = protowire.AppendTag(data, 3, protowire.BytesType)
+			data = protowire.AppendBytes(data, row)
+		}
+	}
+	kv.Value.RawBytes = append([]byte{0, 0, 0, 0, timeseriesTag}, data...)
+	return kv
+}
+
+func TestTsdumpRaw(t *testing.T) {
+	start := time.Date(2022, 11, 8, 14, 0, 0, 0, time.UTC)
+	var in bytes.Buffer
+	enc := gob.NewEncoder(&in)
+	for _, kv := range []tsdumpKeyValue{
+		tsdumpRecord("cr.node.sql.conns", 1, "1", start, true, 2, 3),
+		// The rollups are skipped.
+		tsdumpRecord("cr.node.sql.conns", 2, "1", start, true, 2.5),
+		tsdumpRecord("cr.node.sql.conns", 1, "2", start, false, 5),
+		tsdumpRecord("cr.store.capacity.available", 1, "1", start, true, 1.5e+09),
+		tsdumpRecord("cr.node.sql.service.latency-p99.9", 1, "1", start, true, 2.5e+06),
+		tsdumpRecord("cr.node.sql.service.latency-max", 1, "1", start, true, 4e+06),
+		tsdumpRecord("cr.node.sql.service.latency-count", 1, "1", start, false, 120),
+		tsdumpRecord("cr.node.sys.cpu.combined.percent-normalized", 1, "1", start, true, 0.25),
+	} {
+		require.NoError(t, enc.Encode(kv))
+	}
+	var out bytes.Buffer
+	require.NoError(t, ConvertTsdump(&in, TsdumpRaw, &out))
+	assert.Equal(t, tsdumpOutput, out.String())
+}
+
+func TestTsdumpErrors(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(ConvertTsdump(strings.NewReader(""), "text", io.Discard))
+	err := ConvertTsdump(strings.NewReader(tsdumpInput+"cr.node.sql.conns,yesterday,1,3\n"), TsdumpCSV, io.Discard)
+	assert.EqualError(err, `line 9: parsing time "yesterday" as "2006-01-02T15:04:05.999999999Z07:00": `+
+		`cannot parse "yesterday" as "2006"`)
+	// The families cannot be written again.
+	err = ConvertTsdump(strings.NewReader(tsdumpInput+"cr.node.sql.conns,2022-11-08T14:00:20Z,1,3\n"), TsdumpCSV, io.Discard)
+	assert.EqualError(err, "line 9: The time series of sql_conns are not contiguous")
+
+	// A header is skipped.
+	var buf bytes.Buffer
+	require.NoError(t, ConvertTsdump(strings.NewReader("name,timestamp,source,value\n"+tsdumpInput), TsdumpCSV, &buf))
+	assert.Equal(tsdumpOutput, buf.String())
+
+	var in bytes.Buffer
+	kv := tsdumpRecord("cr.node.sql.conns", 1, "1", time.Now(), true, 1)
+	kv.Value.RawBytes[4] = 1
+	require.NoError(t, gob.NewEncoder(&in).Encode(kv))
+	assert.EqualError(ConvertTsdump(&in, TsdumpRaw, io.Discard), "record 1: cr.node.sql.conns: Invalid time series value")
+	assert.Error(ConvertTsdump(strings.NewReader("not a tsdump"), TsdumpRaw, io.Discard))
+}
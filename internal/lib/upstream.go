@@ -0,0 +1,145 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUpstreamTimeout    = 10 * time.Second
+	defaultUpstreamMaxRetries = 2
+	defaultUpstreamMinBackoff = 100 * time.Millisecond
+	defaultUpstreamMaxBackoff = 2 * time.Second
+	defaultFailureThreshold   = 5
+	defaultBreakerCooldown    = 30 * time.Second
+	upstreamStaleName         = "metrics_exporter_upstream_stale"
+)
+
+// errBreakerOpen is returned when the target is not scraped, since its circuit breaker is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// withDefaults returns the configuration, with the defaults for the unset values.
+func (u Upstream) withDefaults() Upstream {
+	if u.Timeout == 0 {
+		u.Timeout = defaultUpstreamTimeout
+	}
+	if u.MaxRetries == 0 {
+		u.MaxRetries = defaultUpstreamMaxRetries
+	} else if u.MaxRetries < 0 {
+		u.MaxRetries = 0
+	}
+	if u.MinBackoff == 0 {
+		u.MinBackoff = defaultUpstreamMinBackoff
+	}
+	if u.MaxBackoff == 0 {
+		u.MaxBackoff = defaultUpstreamMaxBackoff
+	}
+	if u.MaxBackoff < u.MinBackoff {
+		u.MaxBackoff = u.MinBackoff
+	}
+	if u.FailureThreshold == 0 {
+		u.FailureThreshold = defaultFailureThreshold
+	}
+	if u.Cooldown == 0 {
+		u.Cooldown = defaultBreakerCooldown
+	}
+	return u
+}
+
+// backoff returns the delay before the given retry (starting from 1):
+// half of the exponential backoff is fixed, the other half is random.
+func (u Upstream) backoff(retry int) time.Duration {
+	d := u.MaxBackoff
+	if retry < 32 {
+		if exp := u.MinBackoff << (retry - 1); exp > 0 && exp < d {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// statusError is returned when the target responds with a status other than 200.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+// retryable returns true for network errors, 5xx and 429 responses.
+func retryable(err error) bool {
+	if se, ok := err.(*statusError); ok {
+		return se.code/100 == 5 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// breaker is a circuit breaker. It opens after threshold consecutive failures;
+// once the cooldown has elapsed, a single probe is allowed: if it succeeds
+// the breaker is closed, otherwise it stays open for another cooldown.
+type breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newBreaker(name string, threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns true if the request can be attempted.
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record updates the state of the breaker with the outcome of a request.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		if b.failures >= b.threshold {
+			log.Infof("Circuit breaker for %s closed", b.name)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Warnf("Circuit breaker for %s open after %d failures: %s", b.name, b.failures, err)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
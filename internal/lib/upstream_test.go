@@ -0,0 +1,157 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyUpstream returns a server that fails with the given status
+// while failing is set, and the number of requests received.
+func newFlakyUpstream(t *testing.T, status int, failing *int32) (*httptest.Server, *int32) {
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(failing) != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		_, _ = w.Write([]byte("# TYPE sql_conns gauge\nsql_conns 3\n"))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, &requests
+}
+
+func TestBreaker(t *testing.T) {
+	assert := assert.New(t)
+	b := newBreaker("test", 2, 20*time.Millisecond)
+	failure := errors.New("failure")
+	assert.True(b.allow())
+	b.record(failure)
+	assert.True(b.allow())
+	b.record(failure)
+	assert.False(b.allow())
+
+	time.Sleep(30 * time.Millisecond)
+	// A single probe is allowed after the cooldown.
+	assert.True(b.allow())
+	assert.False(b.allow())
+	b.record(failure)
+	assert.False(b.allow())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.True(b.allow())
+	b.record(nil)
+	assert.True(b.allow())
+	assert.True(b.allow())
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	u := Upstream{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}.withDefaults()
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		d := u.backoff(retry + 1)
+		max *= time.Millisecond
+		assert.GreaterOrEqual(d, max/2)
+		assert.LessOrEqual(d, max)
+	}
+	assert.LessOrEqual(u.backoff(100), time.Second)
+}
+
+func TestReadRetries(t *testing.T) {
+	assert := assert.New(t)
+	failing := int32(1)
+	upstream, requests := newFlakyUpstream(t, http.StatusServiceUnavailable, &failing)
+	config := &Config{
+		URL:      upstream.URL,
+		Upstream: Upstream{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+
+	// All the attempts fail.
+	_, err = reader.ReadMetrics(context.Background())
+	assert.EqualError(err, "503 Service Unavailable")
+	assert.Equal(int32(4), atomic.LoadInt32(requests))
+
+	// Client errors are not retried.
+	upstream404, requests404 := newFlakyUpstream(t, http.StatusNotFound, &failing)
+	config.URL = upstream404.URL
+	reader, err = CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	_, err = reader.ReadMetrics(context.Background())
+	assert.Error(err)
+	assert.Equal(int32(1), atomic.LoadInt32(requests404))
+}
+
+func TestReadBreakerAndStale(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	failing := int32(0)
+	upstream, requests := newFlakyUpstream(t, http.StatusInternalServerError, &failing)
+	config := &Config{
+		URL: upstream.URL,
+		Upstream: Upstream{
+			MaxRetries:       -1,
+			FailureThreshold: 2,
+			Cooldown:         time.Minute,
+			StaleFor:         time.Minute,
+		},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+
+	mfs, err := reader.ReadMetrics(ctx)
+	require.NoError(t, err)
+	assert.Equal(0.0, mfs[upstreamStaleName].Metric[0].GetGauge().GetValue())
+
+	// The last good scrape is served while the upstream is failing.
+	atomic.StoreInt32(&failing, 1)
+	for i := 0; i < 3; i++ {
+		mfs, err = reader.ReadMetrics(ctx)
+		require.NoError(t, err)
+		assert.Equal(3.0, mfs["sql_conns"].Metric[0].GetGauge().GetValue())
+		assert.Equal(1.0, mfs[upstreamStaleName].Metric[0].GetGauge().GetValue())
+	}
+	// The breaker opened after two failures.
+	assert.Equal(int32(3), atomic.LoadInt32(requests))
+
+	// Stale scrapes are served for a bounded time.
+	reader.targets[0].lastGoodAt = time.Now().Add(-2 * time.Minute)
+	_, err = reader.ReadMetrics(ctx)
+	assert.Equal(errBreakerOpen, err)
+}
+
+func TestMultiTargetStale(t *testing.T) {
+	assert := assert.New(t)
+	failing := int32(0)
+	upstream, _ := newFlakyUpstream(t, http.StatusInternalServerError, &failing)
+	config := &Config{
+		Targets:  []Target{{URL: upstream.URL}},
+		Upstream: Upstream{MaxRetries: -1, StaleFor: time.Minute},
+	}
+	reader, err := CreateMetricsReader(config, &http.Transport{})
+	require.NoError(t, err)
+	_, err = reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&failing, 1)
+	mfs, err := reader.ReadMetrics(context.Background())
+	require.NoError(t, err)
+	assert.Contains(mfs, "sql_conns")
+	assert.Equal(0.0, mfs[targetUpName].Metric[0].GetGauge().GetValue())
+	assert.Equal(1.0, mfs[upstreamStaleName].Metric[0].GetGauge().GetValue())
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// ConfigErrors collects all the problems found in a configuration, so that
+// they can be reported at once.
+type ConfigErrors []error
+
+// Error implements error.
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d problems found:\n  %s", len(e), strings.Join(msgs, "\n  "))
+}
+
+// add records the error, if any, with the path of the setting (e.g. bucket.unit).
+// The errors collected for a section are added with the section path.
+func (e *ConfigErrors) add(path string, err error) {
+	switch err := err.(type) {
+	case nil:
+	case ConfigErrors:
+		for _, sub := range err {
+			e.add(path, sub)
+		}
+	case *fieldError:
+		e.add(joinPath(path, err.path), err.err)
+	default:
+		if path == "" {
+			*e = append(*e, err)
+		} else {
+			*e = append(*e, &fieldError{path: path, err: err})
+		}
+	}
+}
+
+// err returns the collected errors, or nil.
+func (e ConfigErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// fieldError is a problem with a setting.
+type fieldError struct {
+	path string
+	err  error
+}
+
+// Error implements error.
+func (e *fieldError) Error() string {
+	return e.path + ": " + e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+func joinPath(parent, child string) string {
+	switch {
+	case parent == "":
+		return child
+	case child == "", strings.HasPrefix(child, "["):
+		return parent + child
+	default:
+		return parent + "." + child
+	}
+}
+
+// checkRegex returns an error, with the position of the problem in the expression,
+// if the regex does not compile.
+func checkRegex(expr string) error {
+	_, err := regexp.Compile(expr)
+	var syntaxErr *syntax.Error
+	if !errors.As(err, &syntaxErr) {
+		return err
+	}
+	res := fmt.Sprintf("Invalid regex %q: %s", expr, syntaxErr.Code)
+	if i := strings.Index(expr, syntaxErr.Expr); syntaxErr.Expr != "" && i >= 0 {
+		res += fmt.Sprintf(" at offset %d, near %q", i, syntaxErr.Expr)
+	}
+	return errors.New(res)
+}
@@ -10,6 +10,8 @@ import (
 	"context"
 	"io"
 	"regexp"
+	"sort"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
@@ -39,22 +41,63 @@ func CreateMetricsWriter(config *Config) *MetricsWriter {
 	}
 }
 
-// WriteMetrics writes the metrics, converting HDR Histogram into Log10 linear histograms.
-func (w *MetricsWriter) WriteMetrics(
-	ctx context.Context, metricFamilies map[string]*dto.MetricFamily, out io.Writer,
-) {
-	for _, mf := range metricFamilies {
+// TranslateMetrics converts, in place, the HDR Histograms into Log10 linear histograms.
+// Histograms matching the exclude regex (and not the include regex) are removed.
+// It stops, returning the context error, if the context is done.
+func (w *MetricsWriter) TranslateMetrics(
+	ctx context.Context, metricFamilies map[string]*dto.MetricFamily,
+) error {
+	for name, mf := range metricFamilies {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if mf.GetType() == dto.MetricType_HISTOGRAM {
-			if w.Include != nil && w.Include.MatchString(mf.GetName()) {
-				// Processing this even it matches the exclude.
-			} else if w.Exclude != nil && w.Exclude.MatchString(mf.GetName()) {
+			if w.excluded(mf) {
 				log.Tracef("Skipping %s", mf.GetName())
-				// Skipping this
+				delete(metricFamilies, name)
 				continue
 			}
 			log.Tracef("Translating %s", mf.GetName())
+			start := time.Now()
 			TranslateHistogram(&w.Config.Bucket, mf)
+			translationSeconds.WithLabelValues(name).Add(time.Since(start).Seconds())
+		}
+	}
+	return nil
+}
+
+// excluded returns true if the histogram matches the exclude regex, and not the include regex.
+func (w *MetricsWriter) excluded(mf *dto.MetricFamily) bool {
+	if w.Include != nil && w.Include.MatchString(mf.GetName()) {
+		// Processing this even it matches the exclude.
+		return false
+	}
+	return w.Exclude != nil && w.Exclude.MatchString(mf.GetName())
+}
+
+// WriteMetrics writes the metrics, converting HDR Histogram into Log10 linear histograms.
+func (w *MetricsWriter) WriteMetrics(
+	ctx context.Context, metricFamilies map[string]*dto.MetricFamily, out io.Writer,
+) {
+	if err := w.TranslateMetrics(ctx, metricFamilies); err != nil {
+		log.Error(err)
+		return
+	}
+	WriteText(out, metricFamilies)
+}
+
+// WriteText writes the metric families, as is, in the Prometheus text format.
+// The families are sorted by name.
+func WriteText(out io.Writer, metricFamilies map[string]*dto.MetricFamily) error {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := expfmt.MetricFamilyToText(out, metricFamilies[name]); err != nil {
+			return err
 		}
-		expfmt.MetricFamilyToText(out, mf)
 	}
+	return nil
 }
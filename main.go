@@ -10,31 +10,39 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
-	"net/http"
 	"os"
 	"runtime"
 	"runtime/debug"
 	"strings"
-	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/cockroachlabs/metrics-exporter/internal/lib"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	// buildVersion is set by the go linker at build time
-	buildVersion           = "<unknown>"
-	defaultCustomFrequency = 10
+	buildVersion = "<unknown>"
 )
 
+// command is a subcommand of the metrics-exporter.
+type command struct {
+	name string
+	help string
+	run  func(args []string) error
+}
+
+var commands = []command{
+	{"serve", "serve the translated metrics (default)", serveCommand},
+	{"convert", "translate a file in the Prometheus text format", convertCommand},
+	{"validate", "validate configuration files", validateCommand},
+	{"preview-buckets", "print the buckets of the translated histograms", previewBucketsCommand},
+	{"query-statement", "print the SQL text of a statement fingerprint", queryStatementCommand},
+	{"tsdump", "convert the output of cockroach debug tsdump into OpenMetrics", tsdumpCommand},
+	{"version", "print version and exit", versionCommand},
+}
+
 func printVersionInfo(buildVersion string) {
 	fmt.Println("metrics-exporter", buildVersion)
 	fmt.Println(runtime.Version(), runtime.GOARCH, runtime.GOOS)
@@ -50,152 +58,73 @@ func printVersionInfo(buildVersion string) {
 	}
 }
 
-func translateFromFile(
-	ctx context.Context, config *lib.BucketConfig, filename string, writer *lib.MetricsWriter,
-) {
-	log.Info("Reading from file :" + filename)
-	var parser expfmt.TextParser
-	var r, err = os.Open(filename)
-	if err != nil {
-		panic("File not found")
-	}
-	metricFamilies, _ := parser.TextToMetricFamilies(r)
-	writer.WriteMetrics(ctx, metricFamilies, os.Stdout)
-
+func versionCommand(args []string) error {
+	printVersionInfo(buildVersion)
+	return nil
 }
 
-func main() {
-	configLocation := flag.String("config", "", "YAML configuration")
-	printVersion := flag.Bool("version", false, "print version and exit")
-	debug := flag.Bool("debug", false, "log debug info")
-	trace := flag.Bool("trace", false, "log trace info")
-	localFile := flag.String("local", "", "use local file to read Prometheus metrics (for testing)")
-	flag.Parse()
-	if *printVersion {
-		printVersionInfo(buildVersion)
-		return
-	}
-	if *debug {
-		log.SetLevel(log.DebugLevel)
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-16s %s\n", c.name, c.help)
 	}
-	if *trace {
-		log.SetLevel(log.TraceLevel)
-	}
-	config := lib.ReadConfig(configLocation)
-	var err error = nil
-	var secureCtx *lib.TLSClientContext = nil
-	var transport = &http.Transport{}
+	fmt.Fprintf(out, "\nRun %s <command> -h for the flags of each command.\n", os.Args[0])
+}
 
-	if config.IsSecure() {
-		secureCtx, err = config.GetTLSClientContext()
-		if err != nil {
-			log.Fatal("Error setting up secure context: ", err)
+// logFlags adds the log level flags. The returned function sets the log level.
+func logFlags(flags *flag.FlagSet) func() {
+	debug := flags.Bool("debug", false, "log debug info")
+	trace := flags.Bool("trace", false, "log trace info")
+	return func() {
+		if *debug {
+			log.SetLevel(log.DebugLevel)
 		}
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				Certificates: []tls.Certificate{secureCtx.Certificate},
-				RootCAs:      secureCtx.CertPool,
-			},
+		if *trace {
+			log.SetLevel(log.TraceLevel)
 		}
 	}
+}
 
-	writer := lib.CreateMetricsWriter(config)
-	ctx := context.Background()
-
-	if *localFile != "" {
-		log.Infof("Reading with:\n%+v\n\n", config)
-		translateFromFile(ctx, &config.Bucket, *localFile, writer)
-		return
+// configFlags adds a flag for each configuration setting (e.g. -bucket.startns).
+// The returned function returns the settings set on the command line.
+func configFlags(flags *flag.FlagSet) func() map[string]string {
+	keys := make(map[string]bool)
+	for _, key := range lib.ConfigKeys() {
+		keys[key] = true
+		flags.String(key, "", "sets "+key+", overriding the configuration file and "+lib.EnvName(key))
 	}
-
-	reader := lib.CreateMetricsReader(config, transport)
-
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-
-		metricFamilies, err := reader.ReadMetrics(ctx)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintln(w, err)
-			return
-		}
-		writer.WriteMetrics(ctx, metricFamilies, w)
-		if config.HasCustom() && config.Custom.Endpoint == "/_status/vars" {
-			customHandler := promhttp.InstrumentMetricHandler(
-				prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer,
-					promhttp.HandlerOpts{
-						DisableCompression: true,
-					}),
-			)
-			customHandler.ServeHTTP(w, r)
-		}
-	})
-	http.Handle("/_status/vars", gziphandler.GzipHandler(handler))
-	if config.HasCustom() {
-		freq := config.Custom.Frequency
-		if freq == 0 {
-			freq = defaultCustomFrequency
-		}
-		if config.Custom.Endpoint != "/_status/vars" {
-			if config.Custom.Endpoint == "" {
-				config.Custom.Endpoint = "/_status/custom"
+	return func() map[string]string {
+		overrides := make(map[string]string)
+		flags.Visit(func(f *flag.Flag) {
+			if keys[f.Name] {
+				overrides[f.Name] = f.Value.String()
 			}
-			http.Handle(config.Custom.Endpoint, promhttp.Handler())
-		}
-		go func() {
-			db, err := lib.NewCollector(ctx, config.Custom)
-			if err != nil {
-				log.Error("error connecting to the database", err)
-				return
-			}
-			go func() {
-				for {
-					err := db.GetCustomMetrics(ctx)
-					if err != nil {
-						log.Error(err)
-					}
-					time.Sleep(time.Duration(freq*int(time.Second)) * time.Nanosecond)
-				}
-			}()
-			if !config.Custom.DisableGetStatement {
-				http.Handle("/statement/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					args := strings.Split(r.URL.Path, "/")
-					if len(args) == 3 {
-						res, err := db.GetStatement(ctx, args[2])
-						if err != nil {
-							w.WriteHeader(http.StatusInternalServerError)
-							fmt.Fprintln(w, err)
-							return
-						}
-						w.WriteHeader(http.StatusOK)
-						fmt.Fprintln(w, res)
-					} else {
-						w.WriteHeader(http.StatusBadRequest)
-						fmt.Fprintln(w, len(args))
-						return
-					}
-				}))
-			}
-		}()
+		})
+		return overrides
 	}
+}
 
-	server := &http.Server{
-		Addr: ":" + fmt.Sprintf("%d", config.Port),
+func main() {
+	log.AddHook(lib.RedactHook{})
+	// Without a command, the flags are the serve ones, as in the previous versions.
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
-	log.Info("Starting proxy")
-	log.Debugf("Bucket config: %+v\n Custom config:%+v\n", config.Bucket, config.Custom)
-
-	if !config.IsSecure() {
-		err = server.ListenAndServe()
-
-	} else {
-		server.TLSConfig, err = config.GetTLSServerContext()
-		if err != nil {
-			log.Fatal("Error setting up secure server: ", err)
-		}
-		err = server.ListenAndServeTLS(config.TLS.Certificate, config.TLS.PrivateKey)
+	if name == "help" {
+		usage()
+		return
 	}
-	if err != nil {
-		log.Fatal("Error starting server: ", err)
+	for _, c := range commands {
+		if c.name == name {
+			if err := c.run(args); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
 	}
+	fmt.Fprintf(flag.CommandLine.Output(), "Unknown command: %s\n", name)
+	usage()
+	os.Exit(2)
 }
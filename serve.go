@@ -0,0 +1,264 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/NYTimes/gziphandler"
+	"github.com/cockroachlabs/metrics-exporter/internal/lib"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// serveCommand runs the proxy, until SIGINT or SIGTERM is received.
+func serveCommand(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	configLocation := flags.String("config", "", "YAML configuration")
+	printVersion := flags.Bool("version", false, "print version and exit")
+	localFile := flags.String("local", "", "deprecated, use the convert command")
+	replayDir := flags.String("replay", "",
+		"serve the scrapes recorded in the capture directory, or the files matching the glob pattern")
+	setLogLevel := logFlags(flags)
+	overrides := configFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [serve] [flags]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *printVersion {
+		printVersionInfo(buildVersion)
+		return nil
+	}
+	setLogLevel()
+	config, err := lib.LoadConfigWithOverrides(*configLocation, overrides())
+	if err != nil {
+		return err
+	}
+	if *localFile != "" {
+		return convert(config, *localFile, os.Stdout)
+	}
+	lib.SetBuildInfo(buildVersion)
+	upstreamTLS := config.UpstreamTLS()
+	transport, err := upstreamTLS.GetTransport()
+	if err != nil {
+		return fmt.Errorf("Error setting up secure context: %w", err)
+	}
+	reader, err := lib.CreateMetricsReader(config, transport)
+	if err != nil {
+		return fmt.Errorf("Error setting up the targets: %w", err)
+	}
+	var source lib.Source = reader
+	if *replayDir != "" {
+		source, err = lib.NewReplayer(*replayDir)
+		if err != nil {
+			return fmt.Errorf("Error setting up replay: %w", err)
+		}
+	} else if config.HasCapture() {
+		reader.Recorder, err = lib.NewRecorder(config.Capture)
+		if err != nil {
+			return fmt.Errorf("Error setting up capture: %w", err)
+		}
+	}
+	// The setup that may fail is completed before the background tasks are started.
+	auth, err := lib.NewAuthenticator(config.Server.Auth)
+	if err != nil {
+		return fmt.Errorf("Error setting up authentication: %w", err)
+	}
+	server := &http.Server{
+		Addr:    ":" + fmt.Sprintf("%d", config.Port),
+		Handler: auth.Wrap(http.DefaultServeMux),
+	}
+	if config.IsSecure() {
+		server.TLSConfig, err = config.GetTLSServerContext()
+		if err != nil {
+			return fmt.Errorf("Error setting up secure server: %w", err)
+		}
+	}
+
+	writer := lib.CreateMetricsWriter(config)
+	lifecycle := lib.NewLifecycle(config.ShutdownGrace)
+	lifecycle.HandleSignals(os.Interrupt, syscall.SIGTERM)
+	ctx := lifecycle.Context()
+
+	health := lib.NewHealth()
+	reloader := lib.NewReloader(*configLocation, config)
+	// The current configuration stays in effect if a reload is rejected, but the exporter is not ready.
+	reloader.Status = health.Component("config")
+	reloader.Overrides = overrides()
+	lifecycle.Go("config reload", reloader.Run)
+	if config.HasDiscovery() && config.Discovery.Source == lib.HTTPDiscovery {
+		lifecycle.Go("discovery", lib.NewDiscoverer(config, reader, reader).Run)
+	}
+	pipeline := lib.CreatePipeline(source, writer)
+	pipeline.Status = health.Component("upstream")
+	// Without scrapes (e.g. while the exporter is not ready) the upstream is probed by the readiness checks.
+	pipeline.Status.SetProbe(func(ctx context.Context) {
+		_, _ = pipeline.Gather(ctx)
+	})
+	reloader.OnReload(func(config *lib.Config) {
+		pipeline.SetWriter(lib.CreateMetricsWriter(config))
+	})
+	if config.HasCustom() {
+		pipeline.Custom = prometheus.DefaultGatherer
+	}
+	if config.HasRemoteWrite() {
+		lifecycle.Go("remote write", lib.NewRemoteWriter(config.RemoteWrite, pipeline).Run)
+	}
+	if config.HasOTLP() {
+		lifecycle.Go("otlp", lib.NewOTLPExporter(config, pipeline).Run)
+	}
+	if config.HasGraphite() {
+		lifecycle.Go("graphite", lib.NewGraphiteSink(config.Graphite, pipeline).Run)
+	}
+	if config.HasInflux() {
+		lifecycle.Go("influx", lib.NewInfluxSink(config.Influx, pipeline).Run)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		// The metrics must be read and translated before the scraper gives up.
+		// Once the response is started, it is completed.
+		scrapeCtx, cancel := context.WithTimeout(ctx, reloader.Config().Scrape.TimeoutFor(r))
+		defer cancel()
+		metricFamilies, readAt, err := pipeline.GatherCached(scrapeCtx)
+		if err != nil {
+			if lib.IsTimeout(err) || scrapeCtx.Err() != nil {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			fmt.Fprintln(w, err)
+			return
+		}
+		lib.SetCacheHeaders(w.Header(), readAt)
+		if lib.WantsInflux(r) {
+			if config.HasCustom() && config.Custom.Endpoint == "/_status/vars" {
+				metricFamilies, err = pipeline.MergeCustom(metricFamilies)
+				if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					fmt.Fprintln(w, err)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", lib.InfluxContentType)
+			if err := lib.WriteInflux(w, metricFamilies, readAt); err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		if err := lib.WriteText(w, metricFamilies); err != nil {
+			log.Error(err)
+			return
+		}
+		if config.HasCustom() && config.Custom.Endpoint == "/_status/vars" {
+			customHandler := promhttp.InstrumentMetricHandler(
+				prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer,
+					promhttp.HandlerOpts{
+						DisableCompression: true,
+					}),
+			)
+			customHandler.ServeHTTP(w, r)
+		}
+	})
+	http.Handle("/_status/vars", gziphandler.GzipHandler(handler))
+	http.Handle(lib.SelfEndpoint, promhttp.HandlerFor(lib.SelfRegistry, promhttp.HandlerOpts{}))
+	http.Handle(lib.LivenessEndpoint, health.LivenessHandler())
+	http.Handle(lib.ReadinessEndpoint, health.ReadinessHandler())
+	if config.HasCustom() {
+		sqlStatus := health.Component("sql")
+		if endpoint := config.Custom.Endpoint; endpoint != "/_status/vars" {
+			if endpoint == "" {
+				endpoint = "/_status/custom"
+			}
+			http.Handle(endpoint, promhttp.Handler())
+		}
+		lifecycle.Go("custom metrics setup", func(ctx context.Context) {
+			db, err := lib.NewCollector(ctx, config.Custom, sqlStatus)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("error connecting to the database", err)
+				}
+				return
+			}
+			lifecycle.OnClose(db.Close)
+			reloader.OnReload(func(config *lib.Config) {
+				db.SetConfig(config.Custom)
+			})
+			// The configuration may have been reloaded while connecting.
+			db.SetConfig(reloader.Config().Custom)
+			if config.HasDiscovery() && config.Discovery.Source == lib.SQLDiscovery {
+				lifecycle.Go("sql discovery", lib.NewDiscoverer(config, reader, db).Run)
+			}
+			if config.Tenants.Discover {
+				lifecycle.Go("tenant discovery", lib.NewTenantDiscoverer(config.Tenants, reader, db).Run)
+			}
+			lifecycle.Go("custom metrics", db.Run)
+			if !config.Custom.DisableGetStatement {
+				http.Handle("/statement/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					args := strings.Split(r.URL.Path, "/")
+					if len(args) == 3 {
+						res, err := db.GetStatement(ctx, args[2])
+						if err != nil {
+							w.WriteHeader(http.StatusInternalServerError)
+							fmt.Fprintln(w, err)
+							return
+						}
+						w.WriteHeader(http.StatusOK)
+						fmt.Fprintln(w, res)
+					} else {
+						w.WriteHeader(http.StatusBadRequest)
+						fmt.Fprintln(w, len(args))
+						return
+					}
+				}))
+			}
+		})
+	}
+
+	log.Info("Starting proxy")
+	log.Debugf("Configuration: %v", config)
+
+	lifecycle.OnDrain(server.Shutdown)
+	// A server that cannot start (e.g. the port is in use) stops the exporter.
+	serverErr := make(chan error, 1)
+	go func() {
+		var err error
+		if !config.IsSecure() {
+			err = server.ListenAndServe()
+		} else {
+			// The certificate is in the server TLS config.
+			err = server.ListenAndServeTLS("", "")
+		}
+		if err != nil && err != http.ErrServerClosed {
+			serverErr <- fmt.Errorf("Error starting server: %w", err)
+			lifecycle.Stop()
+		}
+	}()
+
+	<-lifecycle.Stopping()
+	if err := lifecycle.Shutdown(); err != nil {
+		log.Error("Error shutting down: ", err)
+	}
+	log.Info("Proxy stopped")
+	select {
+	case err := <-serverErr:
+		return err
+	default:
+		return nil
+	}
+}
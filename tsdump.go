@@ -0,0 +1,55 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed
+// by the Apache License, Version 2.0, included in the file
+// LICENSE.md
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cockroachlabs/metrics-exporter/internal/lib"
+)
+
+// tsdumpCommand converts the output of cockroach debug tsdump into
+// OpenMetrics, to backfill Prometheus with promtool tsdb create-blocks-from openmetrics.
+func tsdumpCommand(args []string) error {
+	flags := flag.NewFlagSet("tsdump", flag.ExitOnError)
+	format := flags.String("format", lib.TsdumpCSV, "format of the tsdump: csv or raw")
+	output := flags.String("output", "", "OpenMetrics output file (default stdout)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s tsdump [flags] [tsdump file, default stdin]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	out := os.Stdout
+	if *output != "" {
+		var err error
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	if err := lib.ConvertTsdump(bufio.NewReader(in), *format, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}